@@ -0,0 +1,35 @@
+package scp
+
+import (
+	"errors"
+	"net"
+	"strings"
+)
+
+// Port used for servers given without one
+const defaultPort = "22"
+
+// Turn a server address into the host:port form expected by ssh.Dial. IPv6
+// literals are bracketed, and a server given without a port gets the default
+// SSH port, like with the ssh command.
+func normalizeAddr(server string) (string, error) {
+	host, port, err := net.SplitHostPort(server)
+	if err != nil {
+		// An IPv6 literal without brackets can't carry a port
+		bare := strings.TrimSuffix(strings.TrimPrefix(server, "["), "]")
+		if ip := net.ParseIP(bare); ip != nil && ip.To4() == nil {
+			return net.JoinHostPort(bare, defaultPort), nil
+		}
+
+		var addrErr *net.AddrError
+		if !errors.As(err, &addrErr) || addrErr.Err != "missing port in address" {
+			return "", errors.New("Invalid server address: " + server)
+		}
+		host, port = bare, defaultPort
+	}
+
+	if host == "" || port == "" {
+		return "", errors.New("Invalid server address: " + server)
+	}
+	return net.JoinHostPort(host, port), nil
+}
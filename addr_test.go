@@ -0,0 +1,30 @@
+package scp
+
+import "testing"
+
+func TestNormalizeAddr(t *testing.T) {
+	for _, tc := range []struct {
+		server string
+		want   string
+	}{
+		{"192.0.2.1:22", "192.0.2.1:22"},
+		{"example.com:2222", "example.com:2222"},
+		{"[2001:db8::1]:22", "[2001:db8::1]:22"},
+		{"2001:db8::1", "[2001:db8::1]:22"},
+		{"[2001:db8::1]", "[2001:db8::1]:22"},
+		{"[fe80::1%eth0]:22", "[fe80::1%eth0]:22"},
+		{"example.com", "example.com:22"},
+		{"192.0.2.1", "192.0.2.1:22"},
+	} {
+		got, err := normalizeAddr(tc.server)
+		if err != nil || got != tc.want {
+			t.Errorf("%s: got %q, %v, want %q", tc.server, got, err, tc.want)
+		}
+	}
+
+	for _, server := range []string{"", ":22", "example.com:", "a:b:c"} {
+		if got, err := normalizeAddr(server); err == nil {
+			t.Errorf("%s: got %q, want an error", server, got)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package scp
+
+import (
+	"io"
+	"sync"
+)
+
+// Size of the buffers file bodies are copied through, unless BufferSize is set
+const copyBufferSize = 32 << 10
+
+// Copy buffers, shared by all the transfers running at the same time so that
+// each file doesn't allocate its own
+var copyBuffers = newBufferPool(copyBufferSize)
+
+// Pools of buffers of the other sizes asked for, by size
+var sizedBuffers sync.Map
+
+func newBufferPool(size int) *sync.Pool {
+	return &sync.Pool{
+		New: func() interface{} {
+			buf := make([]byte, size)
+			return &buf
+		},
+	}
+}
+
+// Borrow a buffer of size bytes, the default size if not positive, from the pool.
+// It must be given back with putCopyBuffer.
+func getCopyBuffer(size int) *[]byte {
+	return bufferPool(size).Get().(*[]byte)
+}
+
+func putCopyBuffer(buf *[]byte) {
+	bufferPool(len(*buf)).Put(buf)
+}
+
+func bufferPool(size int) *sync.Pool {
+	if size <= 0 || size == copyBufferSize {
+		return copyBuffers
+	}
+	if p, ok := sizedBuffers.Load(size); ok {
+		return p.(*sync.Pool)
+	}
+	p, _ := sizedBuffers.LoadOrStore(size, newBufferPool(size))
+	return p.(*sync.Pool)
+}
+
+// Hide the ReadFrom and WriteTo methods io.CopyBuffer would use in place of the
+// buffer, those of *os.File fall back to io.Copy and its own buffer when they
+// can't use a system call
+type writerOnly struct{ io.Writer }
+type readerOnly struct{ io.Reader }
+
+// io.Copy copying through buf
+func copyBuffer(w io.Writer, r io.Reader, buf []byte) (int64, error) {
+	return io.CopyBuffer(writerOnly{w}, readerOnly{r}, buf)
+}
+
+// io.CopyN copying through buf
+func copyN(w io.Writer, r io.Reader, n int64, buf []byte) (int64, error) {
+	// A LimitedReader has no WriteTo
+	written, err := io.CopyBuffer(writerOnly{w}, io.LimitReader(r, n), buf)
+	if written == n {
+		return n, nil
+	}
+	if written < n && err == nil {
+		// r ran out early
+		err = io.EOF
+	}
+	return written, err
+}
@@ -0,0 +1,65 @@
+package scp
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Discards what is written, without the ReadFrom of ioutil.Discard, like the
+// stdin of an SSH session
+type nullWriter struct{}
+
+func (nullWriter) Write(p []byte) (int, error) { return len(p), nil }
+
+// Sends of a tree of many small files running in parallel
+func BenchmarkParallelSend(b *testing.B) {
+	dir, err := ioutil.TempDir("", "scp")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for i := 0; i < 50; i++ {
+		if err := ioutil.WriteFile(filepath.Join(dir, fmt.Sprint(i)), make([]byte, 4096), 0644); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	c := &Client{Options: Options{Quiet: true}}
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if err := c.walkAndSend(newTestSendState(nullWriter{}, strings.Repeat("\x00", 200)), &localSource{c: c, path: dir}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// Sends of a large file through buffers of a few sizes
+func BenchmarkBufferSize(b *testing.B) {
+	dir, err := ioutil.TempDir("", "scp")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "large")
+	if err := ioutil.WriteFile(path, make([]byte, 32<<20), 0644); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, size := range []int{4 << 10, 32 << 10, 256 << 10, 1 << 20} {
+		c := &Client{Options: Options{Quiet: true, BufferSize: size}}
+		b.Run(fmt.Sprintf("%dK", size>>10), func(b *testing.B) {
+			b.SetBytes(32 << 20)
+			for i := 0; i < b.N; i++ {
+				if err := c.walkAndSend(newTestSendState(nullWriter{}, ""), &localSource{c: c, path: path}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
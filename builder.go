@@ -0,0 +1,101 @@
+package scp
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ClientBuilder sets up a Client step by step, as an alternative to the options of
+// Dial, which it uses underneath:
+//
+//	c, err := scp.NewClientBuilder("server.com").
+//		User("deploy").
+//		PrivateKey(pemBytes).
+//		HostKeyCallback(callback).
+//		PreserveTimes().
+//		Dial()
+//
+// The first error, such as an unreadable key, is returned by Dial.
+type ClientBuilder struct {
+	server string
+	config ssh.ClientConfig
+	opts   []Option
+	err    error
+}
+
+// NewClientBuilder starts setting up a client of server, whose port defaults to
+// 22
+func NewClientBuilder(server string) *ClientBuilder {
+	return &ClientBuilder{server: server}
+}
+
+// User sets the user to log in as
+func (b *ClientBuilder) User(user string) *ClientBuilder {
+	b.config.User = user
+	return b
+}
+
+// Password adds password authentication
+func (b *ClientBuilder) Password(password string) *ClientBuilder {
+	b.config.Auth = append(b.config.Auth, ssh.Password(password))
+	return b
+}
+
+// PrivateKey adds public key authentication with the unencrypted PEM encoded key
+func (b *ClientBuilder) PrivateKey(pemBytes []byte) *ClientBuilder {
+	signer, err := ssh.ParsePrivateKey(pemBytes)
+	if err != nil {
+		if b.err == nil {
+			b.err = errors.New("Failed to parse private key: " + err.Error())
+		}
+		return b
+	}
+	b.config.Auth = append(b.config.Auth, ssh.PublicKeys(signer))
+	return b
+}
+
+// HostKeyCallback sets how the key of the server is checked, which is required
+func (b *ClientBuilder) HostKeyCallback(cb ssh.HostKeyCallback) *ClientBuilder {
+	b.config.HostKeyCallback = cb
+	return b
+}
+
+// Timeout bounds the time taken to connect, the SSH handshake included
+func (b *ClientBuilder) Timeout(d time.Duration) *ClientBuilder {
+	b.config.Timeout = d
+	return b
+}
+
+// PreserveTimes makes transfers keep the modification times, see WithPreserveTimes
+func (b *ClientBuilder) PreserveTimes() *ClientBuilder {
+	return b.Option(WithPreserveTimes(true))
+}
+
+// Quiet silences the remote scp and the informational messages, see WithQuiet
+func (b *ClientBuilder) Quiet() *ClientBuilder {
+	return b.Option(WithQuiet(true))
+}
+
+// Option adds options of Dial, for the settings without a method of their own
+func (b *ClientBuilder) Option(opts ...Option) *ClientBuilder {
+	b.opts = append(b.opts, opts...)
+	return b
+}
+
+// Dial connects to the server and returns the client set up
+func (b *ClientBuilder) Dial() (*Client, error) {
+	return b.DialContext(context.Background())
+}
+
+// DialContext is like Dial, giving up on connecting as soon as ctx is done
+func (b *ClientBuilder) DialContext(ctx context.Context) (*Client, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	config := b.config
+	opts := append([]Option{WithClientConfig(&config)}, b.opts...)
+	return DialContext(ctx, b.server, opts...)
+}
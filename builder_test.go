@@ -0,0 +1,37 @@
+package scp
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestClientBuilder(t *testing.T) {
+	if _, err := NewClientBuilder("localhost").PrivateKey([]byte("not a key")).Dial(); err == nil {
+		t.Error("got no error for an invalid private key")
+	}
+
+	addr := startTestServer(t, 0, nil)
+	c, err := NewClientBuilder(addr).
+		User("user").
+		Password("password").
+		HostKeyCallback(ssh.InsecureIgnoreHostKey()).
+		Timeout(10 * time.Second).
+		PreserveTimes().
+		Quiet().
+		Option(WithScpPath("/bin/scp")).
+		Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.SshClient.Close()
+
+	if got, err := c.SendCommand("/tmp", os.TempDir()); err != nil || got != "/bin/scp -rtpq /tmp" {
+		t.Errorf("got %q, %v, want %q", got, err, "/bin/scp -rtpq /tmp")
+	}
+	if out, _, err := c.RunCommand("echo ok"); err != nil || string(out) != "ok\n" {
+		t.Errorf("got %q, %v", out, err)
+	}
+}
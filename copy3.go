@@ -0,0 +1,65 @@
+package scp
+
+import (
+	"errors"
+	"strings"
+)
+
+// Copy3 copies srcPath on the server of src to dstPath on the server of dst, like
+// scp -3. The remote scp source and sink talk to each other through this side,
+// which relays their protocol streams without writing anything to local disk.
+// srcPath may be a directory, which is copied recursively.
+func Copy3(src, dst *Client, srcPath, dstPath string) error {
+	sink, err := dst.startSession(dst.context(), dst.sendCommand(dstPath, true, false))
+	if err != nil {
+		return err
+	}
+	defer sink.session.Close()
+
+	source, err := src.startSession(src.context(), src.getReceiveCommand([]string{srcPath}))
+	if err != nil {
+		dst.abort(sink)
+		return err
+	}
+	defer source.session.Close()
+
+	// Acknowledgements go from the sink to the source, starting with the one
+	// asking the source to go
+	acks := make(chan error, 1)
+	go func() {
+		buf := getCopyBuffer(src.BufferSize)
+		defer putCopyBuffer(buf)
+		_, err := copyBuffer(source.stdin, sink.stdout, *buf)
+		source.stdin.Close()
+		acks <- err
+	}()
+
+	// Records and file contents go the other way, until the source is done
+	buf := getCopyBuffer(dst.BufferSize)
+	defer putCopyBuffer(buf)
+	_, copyErr := copyBuffer(sink.stdin, source.stdout, *buf)
+	sink.stdin.Close()
+	if copyErr != nil {
+		// The sink gave up, make sure the source does too
+		source.session.Close()
+	}
+	<-acks
+
+	srcErr := commandError(source.cmd, <-source.done, source.stderr.Bytes())
+	dstErr := commandError(sink.cmd, <-sink.done, sink.stderr.Bytes())
+	// A failure of one side usually makes the other one fail too, report both
+	var msgs []string
+	if srcErr != nil {
+		msgs = append(msgs, "source: "+srcErr.Error())
+	}
+	if dstErr != nil {
+		msgs = append(msgs, "destination: "+dstErr.Error())
+	}
+	if len(msgs) > 0 {
+		return errors.New("Copy failed: " + strings.Join(msgs, "; "))
+	}
+	if copyErr != nil {
+		return errors.New("Copy failed: " + copyErr.Error())
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package scp
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCopy3(t *testing.T) {
+	if _, err := exec.LookPath("scp"); err != nil {
+		t.Skip("scp not available")
+	}
+	src, dst := newTestClient(t), newTestClient(t)
+	defer src.SshClient.Close()
+	defer dst.SshClient.Close()
+
+	dir, err := ioutil.TempDir("", "scp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	from, to := filepath.Join(dir, "from"), filepath.Join(dir, "to")
+	for _, d := range []string{filepath.Join(from, "sub"), to} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := map[string]string{"a": "a", "sub/b": strings.Repeat("b", 100000)}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(from, filepath.FromSlash(name)), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A directory is copied recursively
+	if err := Copy3(src, dst, from, to); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range files {
+		if data, err := ioutil.ReadFile(filepath.Join(to, "from", filepath.FromSlash(name))); err != nil || string(data) != want {
+			t.Errorf("%s: got %d bytes, %v, want %d", name, len(data), err, len(want))
+		}
+	}
+
+	// A single file to a new name
+	if err := Copy3(src, dst, filepath.Join(from, "a"), filepath.Join(to, "renamed")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(to, "renamed")); err != nil || string(data) != "a" {
+		t.Errorf("renamed: got %q, %v, want a", data, err)
+	}
+
+	err = Copy3(src, dst, filepath.Join(dir, "missing"), to)
+	if err == nil || !strings.Contains(err.Error(), "source:") {
+		t.Errorf("got %v for a missing source, want an error of the source", err)
+	}
+}
@@ -0,0 +1,215 @@
+package scp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Option configures Dial
+type Option func(*options)
+
+type options struct {
+	network string
+	config  *ssh.ClientConfig
+	// The client being set up, which gets the connection once dialed
+	client *Client
+	// The first invalid option
+	err error
+}
+
+// WithNetwork sets the network to dial, "tcp4" or "tcp6" forcing an address
+// family. The default is "tcp".
+func WithNetwork(network string) Option {
+	return func(o *options) {
+		o.network = network
+	}
+}
+
+// WithClientConfig sets the SSH configuration, with the user, the authentication
+// methods and the host key check, used to connect
+func WithClientConfig(config *ssh.ClientConfig) Option {
+	return func(o *options) {
+		o.config = config
+	}
+}
+
+// WithProgress sets the OnProgress callback of the client, called as the body of
+// each file is sent. There is no progress reporting by default.
+func WithProgress(fn func(path string, sent, total int64)) Option {
+	return func(o *options) {
+		o.client.OnProgress = fn
+	}
+}
+
+// WithConcurrency sets the number of sessions Send spreads the paths it is given
+// over, see Options.Concurrency. 0 or 1 sends them one after the other, as by
+// default. n must not be negative.
+func WithConcurrency(n int) Option {
+	return func(o *options) {
+		if n < 0 && o.err == nil {
+			o.err = errors.New("Invalid concurrency: " + strconv.Itoa(n))
+		}
+		o.client.Concurrency = n
+	}
+}
+
+// WithBufferSize sets the size of the buffers file bodies are copied through, see
+// Options.BufferSize. Zero or a negative n keeps the default.
+func WithBufferSize(n int) Option {
+	return func(o *options) {
+		o.client.BufferSize = n
+	}
+}
+
+// WithLogger sends the messages of the client to l, as SetLogger does, a nil l
+// silencing them. Informational messages are still left out with Quiet.
+func WithLogger(l Logger) Option {
+	return func(o *options) {
+		o.client.SetLogger(l)
+	}
+}
+
+// WithContext sets the context of the methods of the client which don't take one,
+// see Options.Context
+func WithContext(ctx context.Context) Option {
+	return func(o *options) {
+		o.client.Context = ctx
+	}
+}
+
+// WithScpPath sets the remote scp program, see Options.ScpPath. Empty means scp.
+func WithScpPath(path string) Option {
+	return func(o *options) {
+		o.client.ScpPath = path
+	}
+}
+
+// WithExclude sets a Filter leaving out the entries matching any of the patterns,
+// as understood by path.Match, such as WithExclude(".git", "node_modules", "*.tmp").
+// A pattern without a slash is matched against the name of every entry, at any
+// depth, and one with a slash against the whole path given to Filter. A directory
+// which matches is left out with all its content. It applies on top of a Filter
+// set before.
+func WithExclude(patterns ...string) Option {
+	return func(o *options) {
+		for _, p := range patterns {
+			if _, err := path.Match(p, ""); err != nil && o.err == nil {
+				o.err = errors.New("Invalid exclude pattern: " + p)
+			}
+		}
+
+		prev := o.client.Filter
+		o.client.Filter = func(p string, info os.FileInfo) bool {
+			if prev != nil && !prev(p, info) {
+				return false
+			}
+			return !excluded(p, patterns)
+		}
+	}
+}
+
+// Report whether the slash separated path p matches one of the patterns of
+// WithExclude
+func excluded(p string, patterns []string) bool {
+	name := path.Base(p)
+	for _, pattern := range patterns {
+		target := p
+		if !strings.Contains(pattern, "/") {
+			target = name
+		}
+		if ok, _ := path.Match(pattern, target); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// WithPreserveTimes sets PreserveTimes, making transfers keep the modification
+// times as scp -p does, along with the deprecated PreseveTimes
+func WithPreserveTimes(b bool) Option {
+	return func(o *options) {
+		o.client.setPreserveTimes(b)
+	}
+}
+
+// WithQuiet sets Quiet, which runs the remote scp with -q and leaves out the
+// informational messages of the client, along with the deprecated Quiet of Client
+func WithQuiet(b bool) Option {
+	return func(o *options) {
+		o.client.setQuiet(b)
+	}
+}
+
+// Dial connects to the SSH server and returns a client configured by opts. The
+// port of server defaults to 22. WithClientConfig must be given, if only to check
+// the host key.
+func Dial(server string, opts ...Option) (*Client, error) {
+	return DialContext(context.Background(), server, opts...)
+}
+
+// DialContext is like Dial, giving up on connecting, including the SSH handshake,
+// as soon as ctx is done
+func DialContext(ctx context.Context, server string, opts ...Option) (*Client, error) {
+	o := &options{network: "tcp", client: &Client{}}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.err != nil {
+		return nil, o.err
+	}
+	if o.config == nil {
+		return nil, errors.New("Missing SSH client config")
+	}
+
+	server, err := normalizeAddr(server)
+	if err != nil {
+		return nil, err
+	}
+
+	d := net.Dialer{Timeout: o.config.Timeout}
+	conn, err := d.DialContext(ctx, o.network, server)
+	if err != nil {
+		return nil, err
+	}
+
+	// The handshake knows nothing of ctx, closing the connection interrupts it
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	handshakeDone := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-handshakeDone:
+		}
+	}()
+
+	c, chans, reqs, err := ssh.NewClientConn(conn, server, o.config)
+	close(handshakeDone)
+	if deadline, ok := ctx.Deadline(); ok && err != nil && !time.Now().Before(deadline) {
+		// The connection deadline may go off just before ctx
+		return nil, context.DeadlineExceeded
+	}
+	if ctx.Err() != nil {
+		if err == nil {
+			c.Close()
+		}
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	o.client.SshClient = ssh.NewClient(c, chans, reqs)
+	return o.client, nil
+}
@@ -0,0 +1,131 @@
+package scp
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The client the options set up
+func optionsClient(opts ...Option) *Client {
+	o := &options{client: &Client{}}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o.client
+}
+
+func TestOptionCommands(t *testing.T) {
+	for _, tc := range []struct {
+		opts []Option
+		want string
+	}{
+		{nil, "scp -rt /tmp"},
+		{[]Option{WithScpPath("/usr/local/bin/scp")}, "/usr/local/bin/scp -rt /tmp"},
+		{[]Option{WithScpPath("")}, "scp -rt /tmp"},
+		{[]Option{WithPreserveTimes(true)}, "scp -rtp /tmp"},
+		{[]Option{WithPreserveTimes(true), WithPreserveTimes(false)}, "scp -rt /tmp"},
+		{[]Option{func(o *options) { o.client.PreseveTimes = true }, WithPreserveTimes(false)}, "scp -rt /tmp"},
+		{[]Option{WithQuiet(true)}, "scp -rtq /tmp"},
+		{[]Option{WithQuiet(false)}, "scp -rt /tmp"},
+		{[]Option{WithPreserveTimes(true), WithQuiet(true), WithScpPath("/bin/scp")}, "/bin/scp -rtpq /tmp"},
+	} {
+		if got, err := optionsClient(tc.opts...).SendCommand("/tmp", os.TempDir()); err != nil || got != tc.want {
+			t.Errorf("got %q, %v, want %q", got, err, tc.want)
+		}
+	}
+}
+
+func TestWithExclude(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, f := range []string{"a.txt", "b.tmp", "node_modules/x.js", "lib/node_modules.txt", "lib/c.tmp", "lib/keep/d.txt"} {
+		p := filepath.Join(dir, "src", filepath.FromSlash(f))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A filter set before still applies, and doesn't see what is under a
+	// pruned directory
+	var seen []string
+	c := optionsClient(WithExclude(".*"), func(o *options) {
+		prev := o.client.Filter
+		o.client.Filter = func(p string, info os.FileInfo) bool {
+			seen = append(seen, p)
+			return prev(p, info)
+		}
+	}, WithExclude("node_modules", "*.tmp", "src/lib/keep"))
+	var got []string
+	err = (&localSource{c: c, path: filepath.Join(dir, "src")}).Walk(func(path, remotePath string, info os.FileInfo) error {
+		got = append(got, remotePath)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"src", "src/a.txt", "src/lib", "src/lib/node_modules.txt"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	for _, p := range seen {
+		if strings.HasPrefix(p, "src/node_modules/") || strings.HasPrefix(p, "src/lib/keep/") {
+			t.Errorf("filter called for %s, in a pruned directory", p)
+		}
+	}
+
+	o := &options{client: &Client{}}
+	WithExclude("[")(o)
+	if o.err == nil {
+		t.Error("got no error for an invalid pattern")
+	}
+}
+
+func TestDialContextCancel(t *testing.T) {
+	// A server accepting connections but never answering the handshake
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	config := WithClientConfig(&ssh.ClientConfig{HostKeyCallback: ssh.InsecureIgnoreHostKey()})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	if _, err := DialContext(ctx, l.Addr().String(), config); err != context.Canceled {
+		t.Errorf("got %v once cancelled, want context.Canceled", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("gave up after %v", elapsed)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := DialContext(ctx, l.Addr().String(), config); err != context.DeadlineExceeded {
+		t.Errorf("got %v past the deadline, want context.DeadlineExceeded", err)
+	}
+}
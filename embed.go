@@ -0,0 +1,72 @@
+//go:build go1.16
+// +build go1.16
+
+package scp
+
+import (
+	"embed"
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+)
+
+// SendEmbed sends the files embedded under root in efs into the remote dst
+// directory, root itself being left out. Embedded files are all read-only and
+// have no modification time, so the files get 0644 instead, see SendEmbedMode,
+// and directories get 0755. With PreserveTimes, the files get the current time.
+func (c *Client) SendEmbed(dst string, efs embed.FS, root string) error {
+	return c.SendEmbedMode(dst, efs, root, 0644)
+}
+
+// SendEmbedMode is like SendEmbed, giving fileMode to the files, 0644 if zero
+func (c *Client) SendEmbedMode(dst string, efs embed.FS, root string, fileMode os.FileMode) error {
+	if fileMode == 0 {
+		fileMode = 0644
+	}
+
+	var entries []TreeEntry
+	var files []fs.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	err := fs.WalkDir(efs, root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel := path.Base(p)
+		if p != root {
+			rel = p[len(root)+1:]
+			if root == "." {
+				rel = p
+			}
+		}
+
+		if d.IsDir() {
+			if p != root {
+				entries = append(entries, TreeEntry{Path: rel, Mode: 0755})
+			}
+			return nil
+		}
+
+		f, err := efs.Open(p)
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		entries = append(entries, TreeEntry{Path: rel, Mode: fileMode, Reader: f, Size: fi.Size()})
+		return nil
+	})
+	if err != nil {
+		return errors.New("Failed to read embedded files: " + err.Error())
+	}
+
+	return c.SendTree(dst, entries)
+}
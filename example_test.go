@@ -1,10 +1,12 @@
 package scp_test
 
 import (
+	"fmt"
 	"log"
 	"os"
 
 	"github.com/aedavelli/go-scp"
+	"golang.org/x/crypto/ssh"
 )
 
 func ExampleClient_Send() {
@@ -24,3 +26,26 @@ func ExampleClient_Send() {
 	}
 
 }
+
+func ExampleWithProgress() {
+	c, err := scp.Dial("server.com", scp.WithClientConfig(&ssh.ClientConfig{
+		User:            "username",
+		Auth:            []ssh.AuthMethod{ssh.Password("password")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}), scp.WithProgress(func(path string, sent, total int64) {
+		if total > 0 {
+			fmt.Printf("\r%s: %d%%", path, sent*100/total)
+		}
+		if sent == total {
+			fmt.Println()
+		}
+	}))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer c.SshClient.Close()
+
+	if err := c.Send("/tmp", "big.iso"); err != nil {
+		log.Fatal(err)
+	}
+}
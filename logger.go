@@ -0,0 +1,166 @@
+package scp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Logger receives the messages of a Client, such as the files copied and the
+// warnings. *log.Logger satisfies it.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Printf(format string, v ...interface{}) {}
+
+// SetLogger sends all the messages of the client to l, a nil l silencing them. By
+// default informational messages go to stdout, unless Quiet is set, and warnings
+// to stderr.
+func (c *Client) SetLogger(l Logger) {
+	if l == nil {
+		l = nopLogger{}
+	}
+	c.mu.Lock()
+	c.logger = l
+	c.mu.Unlock()
+}
+
+// The logger given to SetLogger, nil if none
+func (c *Client) getLogger() Logger {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.logger
+}
+
+// Log an informational message, unless Quiet is set
+func (c *Client) infof(format string, v ...interface{}) {
+	if c.quiet() {
+		return
+	}
+	if l := c.getLogger(); l != nil {
+		l.Printf(format, v...)
+		return
+	}
+	fmt.Printf(format+"\n", v...)
+}
+
+// Log a warning
+func (c *Client) warnf(format string, v ...interface{}) {
+	if l := c.getLogger(); l != nil {
+		l.Printf(format, v...)
+		return
+	}
+	fmt.Fprintf(os.Stderr, format+"\n", v...)
+}
+
+// Log a debug message, when Debug is set, the same way as warnings
+func (c *Client) debugf(format string, v ...interface{}) {
+	if c.Debug {
+		c.warnf("scp: "+format, v...)
+	}
+}
+
+// Show s with its non printable bytes in hex
+func printable(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x20 && s[i] < 0x7f && s[i] != '\\' {
+			b.WriteByte(s[i])
+		} else {
+			fmt.Fprintf(&b, "\\x%02x", s[i])
+		}
+	}
+	return b.String()
+}
+
+// Types of LogEvent
+const (
+	EventFileStart    = "file_start"
+	EventFileCopied   = "file_copied"
+	EventFileReceived = "file_received"
+	EventDirEnter     = "dir_enter"
+	EventDirExit      = "dir_exit"
+	EventError        = "error"
+)
+
+// LogEvent is a step of a transfer, given to loggers implementing EventLogger
+type LogEvent struct {
+	Event string
+	// Path is a local path, except for the directories sent, whose path is
+	// relative to the remote destination
+	Path string
+	// Bytes and Duration are set once a file is done
+	Bytes    int64
+	Duration time.Duration
+	Err      error
+}
+
+// EventLogger is a Logger which also takes structured events. When the logger
+// given to SetLogger implements it, the client reports the start and end of
+// every file and directory, and the errors ending transfers.
+type EventLogger interface {
+	Logger
+	LogEvent(ev LogEvent)
+}
+
+func (c *Client) logEvent(ev LogEvent) {
+	if el, ok := c.getLogger().(EventLogger); ok {
+		el.LogEvent(ev)
+	}
+}
+
+// JSONLogger is an EventLogger writing one JSON object per line, such as
+// {"event":"file_copied","path":"a.txt","bytes":123,"ms":45}. Messages logged
+// with Printf have the "message" event and a "msg" field.
+type JSONLogger struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewJSONLogger creates a JSONLogger writing to w
+func NewJSONLogger(w io.Writer) *JSONLogger {
+	return &JSONLogger{w: w}
+}
+
+type jsonEntry struct {
+	Event string `json:"event"`
+	Path  string `json:"path,omitempty"`
+	Bytes *int64 `json:"bytes,omitempty"`
+	Ms    *int64 `json:"ms,omitempty"`
+	Error string `json:"error,omitempty"`
+	Msg   string `json:"msg,omitempty"`
+}
+
+func (l *JSONLogger) Printf(format string, v ...interface{}) {
+	l.write(jsonEntry{Event: "message", Msg: fmt.Sprintf(format, v...)})
+}
+
+func (l *JSONLogger) LogEvent(ev LogEvent) {
+	e := jsonEntry{Event: ev.Event, Path: ev.Path}
+	if ev.Event == EventFileCopied || ev.Event == EventFileReceived {
+		ms := ev.Duration.Milliseconds()
+		e.Bytes, e.Ms = &ev.Bytes, &ms
+	}
+	if ev.Err != nil {
+		e.Error = ev.Err.Error()
+	}
+	l.write(e)
+}
+
+func (l *JSONLogger) write(e jsonEntry) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Write(append(b, '\n'))
+}
@@ -0,0 +1,95 @@
+package scp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJSONLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewJSONLogger(&buf)
+	l.LogEvent(LogEvent{Event: EventFileStart, Path: "a.txt"})
+	l.LogEvent(LogEvent{Event: EventFileCopied, Path: "a.txt", Bytes: 123, Duration: 45 * time.Millisecond})
+	l.LogEvent(LogEvent{Event: EventDirEnter, Path: "dir"})
+	l.LogEvent(LogEvent{Event: EventError, Err: errors.New("Remote error: boom")})
+	l.Printf("Copied: %s", "a.txt")
+
+	want := `{"event":"file_start","path":"a.txt"}
+{"event":"file_copied","path":"a.txt","bytes":123,"ms":45}
+{"event":"dir_enter","path":"dir"}
+{"event":"error","error":"Remote error: boom"}
+{"event":"message","msg":"Copied: a.txt"}
+`
+	if buf.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", buf.String(), want)
+	}
+
+	// A transfer reports its steps, every line being a JSON object
+	dir, err := ioutil.TempDir("", "scp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	buf.Reset()
+	c := &Client{}
+	c.SetLogger(l)
+	stream := "D0755 0 d\nC0644 3 f\nabc\x00E\n"
+	if err := c.receive(bufio.NewReader(strings.NewReader(stream)), ioutil.Discard, dir); err != nil {
+		t.Fatal(err)
+	}
+	var events []string
+	for _, line := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+		var e map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("%q: %v", line, err)
+		}
+		events = append(events, e["event"].(string))
+	}
+	if got, want := strings.Join(events, " "), "dir_enter file_start file_received message dir_exit"; got != want {
+		t.Errorf("got events %s, want %s", got, want)
+	}
+}
+
+func TestDebug(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, debug := range []bool{false, true} {
+		l := &lockedLogger{}
+		c := &Client{Options: Options{Quiet: true, Debug: debug}}
+		c.SetLogger(l)
+		stream := "T1 0 1 0\nC0644 3 f\nabc\x00\x01odd\tname\n"
+		if err := c.receive(bufio.NewReader(strings.NewReader(stream)), ioutil.Discard, dir); err != nil {
+			t.Fatal(err)
+		}
+
+		// The records both ways, in order, without the file contents
+		want := []string{
+			`scp: > \x00`,
+			`scp: < T1 0 1 0\x0a`,
+			`scp: > \x00`,
+			`scp: < C0644 3 f\x0a`,
+			`scp: > \x00`,
+			`scp: < \x00`,
+			`scp: > \x00`,
+			`scp: < \x01odd\x09name\x0a`,
+			"odd\tname",
+		}
+		if !debug {
+			want = want[len(want)-1:]
+		}
+		if got := strings.Join(l.lines, "\n"); got != strings.Join(want, "\n") {
+			t.Errorf("debug %v: got\n%s\nwant\n%s", debug, got, strings.Join(want, "\n"))
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package scp
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ParseManifest reads a manifest in the format of sha256sum, as written by Send
+// with Manifest set, and returns the hashes by path
+func ParseManifest(r io.Reader) (map[string]string, error) {
+	hashes := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		// The two fields are separated by a space and a space or a star,
+		// the latter marking files hashed in binary mode
+		i := strings.IndexByte(line, ' ')
+		if i < 0 || i+2 > len(line) || (line[i+1] != ' ' && line[i+1] != '*') {
+			return nil, fmt.Errorf("Invalid manifest line %d", n)
+		}
+		sum := strings.ToLower(line[:i])
+		if b, err := hex.DecodeString(sum); err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("Invalid hash on manifest line %d", n)
+		}
+		hashes[line[i+2:]] = sum
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.New("Failed to read manifest: " + err.Error())
+	}
+	return hashes, nil
+}
+
+// SHA-256 of a file to send
+type fileHash struct {
+	path, remotePath, sum string
+}
+
+// Hash the regular files of the sources which are to be sent, in no particular
+// order, HashWorkers files at a time
+func (c *Client) hashFiles(sources []Source, skip map[string]bool) ([]fileHash, error) {
+	workers := c.HashWorkers
+	if workers <= 0 {
+		workers = 1
+	}
+
+	type job struct {
+		src              Source
+		path, remotePath string
+	}
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		hashes   []fileHash
+		firstErr error
+		jobs     = make(chan job)
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				sum, err := hashFile(j.src, j.path, c.BufferSize)
+				mu.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = err
+				}
+				hashes = append(hashes, fileHash{j.path, j.remotePath, sum})
+				mu.Unlock()
+			}
+		}()
+	}
+
+	var err error
+	for _, src := range sources {
+		err = c.quietSource(src).Walk(func(path, remotePath string, info os.FileInfo) error {
+			if !info.Mode().IsRegular() || skip[remotePath] {
+				return nil
+			}
+			mu.Lock()
+			err := firstErr
+			mu.Unlock()
+			if err != nil {
+				return err
+			}
+			jobs <- job{src, path, remotePath}
+			return nil
+		})
+		if err != nil {
+			break
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if err == nil {
+		err = firstErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return hashes, nil
+}
+
+// Compare the hashes of the files to send to VerifyManifest. The ones which don't
+// match are returned with SkipMismatched, otherwise they make it fail.
+func (c *Client) verifyManifest(hashes []fileHash) (map[string]bool, error) {
+	mismatched := make(map[string]bool)
+	for _, h := range hashes {
+		if want, ok := c.VerifyManifest[h.remotePath]; !ok || h.sum != want {
+			mismatched[h.remotePath] = true
+		}
+	}
+
+	names := make([]string, 0, len(mismatched))
+	for name := range mismatched {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if len(names) > 0 && !c.SkipMismatched {
+		return nil, errors.New("Files don't match the manifest: " + strings.Join(names, ", "))
+	}
+	for _, name := range names {
+		c.warnf("Skipped: %s doesn't match the manifest", name)
+	}
+	return mismatched, nil
+}
+
+// Compute the SHA-256 of a file of src, in hex, through a buffer of bufSize
+func hashFile(src Source, path string, bufSize int) (string, error) {
+	f, err := src.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("Failed to open local file: %w", err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	buf := getCopyBuffer(bufSize)
+	defer putCopyBuffer(buf)
+	if _, err := copyBuffer(h, f, *buf); err != nil {
+		return "", fmt.Errorf("Failed to hash %s: %w", path, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Send the manifest as a file named ManifestName at the top of the destination
+func (c *Client) sendManifest(s *sendState) error {
+	if c.preserveTimes() {
+		if ok, err := c.writeRecord(s, fmt.Sprintf("T%d 0 %d 0\n", time.Now().Unix(), time.Now().Unix())); !ok {
+			return c.manifestRefused(err)
+		}
+	}
+	if ok, err := c.writeRecord(s, fmt.Sprintf("C%s %d %s\n", c.formatMode(0644), s.manifest.Len(), c.ManifestName)); !ok {
+		return c.manifestRefused(err)
+	}
+	if _, err := s.w.Write(s.manifest.Bytes()); err != nil {
+		return errors.New("Copy failed: " + err.Error())
+	}
+	if ok, err := c.writeRecord(s, "\x00"); !ok {
+		return c.manifestRefused(err)
+	}
+	c.infof("Copied: %s", c.ManifestName)
+	return nil
+}
+
+// A warning about the manifest fails the transfer, which isn't worth much
+// without it
+func (c *Client) manifestRefused(err error) error {
+	if err != nil {
+		return err
+	}
+	return errors.New("Remote refused the manifest " + c.ManifestName)
+}
@@ -0,0 +1,104 @@
+package scp
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// HostProgress is an update sent by SendToHostsProgress
+type HostProgress struct {
+	// Client is the client the update is about
+	Client *Client
+	// Path is the local file being sent, Sent and Total its progress
+	Path  string
+	Sent  int64
+	Total int64
+	// Bytes is the number of bytes sent so far to all the clients together
+	Bytes int64
+	// Done marks the last update of a client, Err being the result of its Send
+	Done bool
+	Err  error
+}
+
+// SendToHosts sends localPath to dst on every client concurrently and returns the
+// error of each client, nil on success.
+func SendToHosts(clients []*Client, dst, localPath string) map[*Client]error {
+	return SendToHostsLimit(clients, dst, localPath, 0)
+}
+
+// SendToHostsLimit is like SendToHosts but runs at most limit transfers at a time.
+// A limit of zero or less means no limit.
+func SendToHostsLimit(clients []*Client, dst, localPath string, limit int) map[*Client]error {
+	return sendToHosts(clients, limit, func(c *Client) error {
+		return c.Send(dst, localPath)
+	})
+}
+
+// SendToHostsProgress sends the paths to dst on every client, at most limit at a
+// time, and reports the progress of all of them on the progress channel, which is
+// closed once every transfer is done. A failing client doesn't stop the others,
+// its error is reported in its last update and in the returned map. The channel
+// must be drained by another goroutine, transfers wait for their updates to be
+// received.
+func SendToHostsProgress(clients []*Client, dst string, paths []string, limit int, progress chan<- HostProgress) map[*Client]error {
+	defer close(progress)
+
+	var bytes int64
+	return sendToHosts(clients, limit, func(c *Client) error {
+		// The files in progress and what was sent of them, the client's
+		// sessions sending files at the same time with Concurrency
+		var mu sync.Mutex
+		last := make(map[string]int64)
+
+		// Send with a copy of the client, so the caller's one isn't touched
+		cc := c.WithOptions(c.options())
+		cc.OnProgress = func(path string, sent, total int64) {
+			if c.OnProgress != nil {
+				c.OnProgress(path, sent, total)
+			}
+			mu.Lock()
+			delta := sent - last[path]
+			if last[path] = sent; sent == total {
+				delete(last, path)
+			}
+			mu.Unlock()
+			n := atomic.AddInt64(&bytes, delta)
+
+			progress <- HostProgress{Client: c, Path: path, Sent: sent, Total: total, Bytes: n}
+		}
+
+		err := cc.Send(dst, paths...)
+		progress <- HostProgress{Client: c, Bytes: atomic.LoadInt64(&bytes), Done: true, Err: err}
+		return err
+	})
+}
+
+// Run send for every client, at most limit at a time, and collect the errors
+func sendToHosts(clients []*Client, limit int, send func(c *Client) error) map[*Client]error {
+	if limit <= 0 || limit > len(clients) {
+		limit = len(clients)
+	}
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs = make(map[*Client]error, len(clients))
+		sem  = make(chan struct{}, limit)
+	)
+	for _, c := range clients {
+		wg.Add(1)
+		go func(c *Client) {
+			defer wg.Done()
+			sem <- struct{}{}
+			err := send(c)
+			<-sem
+
+			mu.Lock()
+			errs[c] = err
+			mu.Unlock()
+		}(c)
+	}
+	wg.Wait()
+
+	return errs
+}
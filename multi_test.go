@@ -0,0 +1,105 @@
+package scp
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestSendToHostsProgress(t *testing.T) {
+	if _, err := exec.LookPath("scp"); err != nil {
+		t.Skip("scp not available")
+	}
+	c := newTestClient(t)
+	defer c.SshClient.Close()
+	// The files are sent over several sessions at once, reporting their
+	// progress concurrently
+	c.Concurrency = 3
+
+	dir, err := ioutil.TempDir("", "scp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	for _, d := range []string{src, dst} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var paths []string
+	for i := 0; i < 6; i++ {
+		p := filepath.Join(src, fmt.Sprint(i))
+		if err := ioutil.WriteFile(p, make([]byte, 1<<20), 0644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, p)
+	}
+
+	progress := make(chan HostProgress)
+	last := make(chan HostProgress, 1)
+	go func() {
+		var p HostProgress
+		for p = range progress {
+		}
+		last <- p
+	}()
+	errs := SendToHostsProgress([]*Client{c}, dst, paths, 0, progress)
+	if err := errs[c]; err != nil {
+		t.Fatal(err)
+	}
+	if p := <-last; !p.Done || p.Bytes != 6<<20 {
+		t.Errorf("got a last update %+v, want Done with %d bytes", p, 6<<20)
+	}
+}
+
+func TestSendToHosts(t *testing.T) {
+	if _, err := exec.LookPath("scp"); err != nil {
+		t.Skip("scp not available")
+	}
+	dir, err := ioutil.TempDir("", "scp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	if err := os.Mkdir(dst, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(src, []byte("config"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Hosts which are down don't stop the other one, the only one writing the
+	// file
+	var clients []*Client
+	for i := 0; i < 3; i++ {
+		c := newTestClient(t)
+		defer c.SshClient.Close()
+		clients = append(clients, c)
+	}
+	up := clients[1]
+	clients[0].SshClient.Close()
+	clients[2].SshClient.Close()
+
+	for _, limit := range []int{0, 1} {
+		if err := os.Remove(filepath.Join(dst, "src")); err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+		errs := SendToHostsLimit(clients, dst, src, limit)
+		if len(errs) != len(clients) {
+			t.Errorf("limit %d: got %d results, want %d", limit, len(errs), len(clients))
+		}
+		for i, c := range clients {
+			if err, ok := errs[c]; !ok || (err == nil) != (c == up) {
+				t.Errorf("limit %d: client %d: got %v, %v", limit, i, err, ok)
+			}
+		}
+		if data, err := ioutil.ReadFile(filepath.Join(dst, "src")); err != nil || string(data) != "config" {
+			t.Errorf("limit %d: got %q, %v, want config", limit, data, err)
+		}
+	}
+}
@@ -0,0 +1,325 @@
+package scp
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Pool keeps one Client per server address, dialing it on first use and sharing
+// it between callers, since a single SSH connection carries any number of
+// concurrent transfers. A connection left unused for the idle TTL is closed, and
+// one found broken is dropped, the next caller dialing again.
+type Pool struct {
+	dial    func(addr string) (*Client, error)
+	maxOpen int
+	idleTTL time.Duration
+
+	// Consecutive failures opening the breaker of a server, and for how long
+	breakerThreshold int
+	breakerCooldown  time.Duration
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	conns    map[string]*poolConn
+	breakers map[string]*breaker
+	closed   bool
+}
+
+type poolConn struct {
+	addr      string
+	client    *Client
+	err       error
+	ready     chan struct{} // closed once dialing is done
+	users     int
+	idleSince time.Time
+	timer     *time.Timer
+}
+
+// Failures of a server, with its breaker open until openUntil once there are
+// enough of them
+type breaker struct {
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+// ErrCircuitOpen is returned by the pool for a server which failed too many times
+// in a row, until its cooldown is over
+var ErrCircuitOpen = errors.New("Circuit open, the server failed too many times")
+
+// PoolOption configures NewPool
+type PoolOption func(*Pool)
+
+// WithBreaker makes the pool stop using a server after threshold failures in a
+// row, of the dial or of the operation, failing fast with ErrCircuitOpen for the
+// cooldown. A single operation is then let through to probe the server, which
+// closes the breaker on success or opens it for another cooldown on failure.
+func WithBreaker(threshold int, cooldown time.Duration) PoolOption {
+	return func(p *Pool) {
+		p.breakerThreshold = threshold
+		p.breakerCooldown = cooldown
+	}
+}
+
+// NewPool creates a pool connecting to servers with dial. At most maxOpen
+// connections are open at once, zero meaning no limit: when the limit is reached
+// the least recently used idle connection is closed to make room, or the caller
+// waits for one to become idle. An idleTTL of zero keeps idle connections open
+// until the pool is closed.
+func NewPool(dial func(addr string) (*Client, error), maxOpen int, idleTTL time.Duration, opts ...PoolOption) *Pool {
+	p := &Pool{
+		dial:     dial,
+		maxOpen:  maxOpen,
+		idleTTL:  idleTTL,
+		conns:    make(map[string]*poolConn),
+		breakers: make(map[string]*breaker),
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+// Do calls fn with the client for addr, dialing it if needed
+func (p *Pool) Do(addr string, fn func(c *Client) error) (err error) {
+	if err := p.allow(addr); err != nil {
+		return err
+	}
+	defer func() { p.record(addr, err) }()
+
+	pc, err := p.acquire(addr)
+	if err != nil {
+		return err
+	}
+	defer p.release(pc)
+
+	if err = fn(pc.client); err != nil && !pc.alive() {
+		// Don't hand the broken connection to the next caller
+		p.mu.Lock()
+		p.forget(pc)
+		p.mu.Unlock()
+	}
+	return err
+}
+
+// Send the paths to dst on the server at addr, see Client.Send
+func (p *Pool) Send(addr, dst string, paths ...string) error {
+	return p.Do(addr, func(c *Client) error {
+		return c.Send(dst, paths...)
+	})
+}
+
+// Receive the remote paths from the server at addr into the local dst, see
+// Client.Receive
+func (p *Pool) Receive(addr, dst string, paths ...string) error {
+	return p.Do(addr, func(c *Client) error {
+		return c.Receive(dst, paths...)
+	})
+}
+
+// Close closes the idle connections right away and the others as soon as they
+// are done. The pool can't be used afterwards.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	for _, pc := range p.conns {
+		if pc.users == 0 {
+			p.closeConn(pc)
+		}
+	}
+	p.cond.Broadcast()
+	return nil
+}
+
+// Fail fast with ErrCircuitOpen if the breaker of addr is open, or if it is
+// already being probed
+func (p *Pool) allow(addr string) error {
+	if p.breakerThreshold <= 0 {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	b, ok := p.breakers[addr]
+	if !ok || b.failures < p.breakerThreshold {
+		return nil
+	}
+	if b.probing || time.Now().Before(b.openUntil) {
+		return ErrCircuitOpen
+	}
+	b.probing = true
+	return nil
+}
+
+// Count the outcome of an operation on addr for its breaker
+func (p *Pool) record(addr string, err error) {
+	if p.breakerThreshold <= 0 || err == ErrCircuitOpen {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err == nil {
+		delete(p.breakers, addr)
+		return
+	}
+	b, ok := p.breakers[addr]
+	if !ok {
+		b = &breaker{}
+		p.breakers[addr] = b
+	}
+	b.failures++
+	b.probing = false
+	if b.failures >= p.breakerThreshold {
+		b.openUntil = time.Now().Add(p.breakerCooldown)
+	}
+}
+
+func (p *Pool) acquire(addr string) (*poolConn, error) {
+	p.mu.Lock()
+	for {
+		if p.closed {
+			p.mu.Unlock()
+			return nil, errors.New("Pool is closed")
+		}
+
+		if pc, ok := p.conns[addr]; ok {
+			pc.users++
+			if pc.timer != nil {
+				pc.timer.Stop()
+				pc.timer = nil
+			}
+			p.mu.Unlock()
+
+			<-pc.ready
+			if pc.err != nil {
+				p.release(pc)
+				return nil, pc.err
+			}
+			return pc, nil
+		}
+
+		if p.maxOpen <= 0 || len(p.conns) < p.maxOpen || p.evictIdle() {
+			break
+		}
+		p.cond.Wait()
+	}
+
+	// Dial without holding the lock, other callers for addr wait on ready
+	pc := &poolConn{addr: addr, ready: make(chan struct{}), users: 1}
+	p.conns[addr] = pc
+	p.mu.Unlock()
+
+	pc.client, pc.err = p.dial(addr)
+	if pc.err == nil && pc.client == nil {
+		pc.err = errors.New("Failed to dial " + addr)
+	}
+	if pc.err != nil {
+		p.mu.Lock()
+		if p.conns[addr] == pc {
+			delete(p.conns, addr)
+		}
+		p.cond.Broadcast()
+		p.mu.Unlock()
+	}
+	close(pc.ready)
+
+	if pc.err != nil {
+		p.release(pc)
+		return nil, pc.err
+	}
+	if pc.client.SshClient != nil {
+		go p.watch(pc)
+	}
+	return pc, nil
+}
+
+// Forget the connection of pc once it is over, whether closed by the server or
+// broken, so that the next caller dials again
+func (p *Pool) watch(pc *poolConn) {
+	pc.client.SshClient.Wait()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.forget(pc)
+}
+
+// Report whether the connection of pc still gets through to the server
+func (pc *poolConn) alive() bool {
+	if pc.client.SshClient == nil {
+		return false
+	}
+	_, _, err := pc.client.SshClient.SendRequest("keepalive@openssh.com", true, nil)
+	return err == nil
+}
+
+// Drop pc from the pool, leaving it to be closed by its last user. The lock must
+// be held.
+func (p *Pool) forget(pc *poolConn) {
+	if pc.timer != nil {
+		pc.timer.Stop()
+		pc.timer = nil
+	}
+	if p.conns[pc.addr] == pc {
+		delete(p.conns, pc.addr)
+		p.cond.Broadcast()
+	}
+}
+
+func (p *Pool) release(pc *poolConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pc.users--
+	if pc.users > 0 || pc.err != nil {
+		return
+	}
+
+	if p.closed || p.conns[pc.addr] != pc {
+		p.closeConn(pc)
+		return
+	}
+
+	pc.idleSince = time.Now()
+	if p.idleTTL > 0 {
+		pc.timer = time.AfterFunc(p.idleTTL, func() { p.expire(pc) })
+	}
+	// Waiters may now evict it to make room
+	p.cond.Broadcast()
+}
+
+// Close the connection if it was left idle for the whole TTL
+func (p *Pool) expire(pc *poolConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.conns[pc.addr] == pc && pc.users == 0 && time.Since(pc.idleSince) >= p.idleTTL {
+		p.closeConn(pc)
+	}
+}
+
+// Close the least recently used idle connection, reporting whether there was one
+func (p *Pool) evictIdle() bool {
+	var oldest *poolConn
+	for _, pc := range p.conns {
+		if pc.users == 0 && (oldest == nil || pc.idleSince.Before(oldest.idleSince)) {
+			oldest = pc
+		}
+	}
+	if oldest == nil {
+		return false
+	}
+
+	p.closeConn(oldest)
+	return true
+}
+
+func (p *Pool) closeConn(pc *poolConn) {
+	p.forget(pc)
+	pc.client.SshClient.Close()
+}
@@ -0,0 +1,209 @@
+package scp
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPoolBreaker(t *testing.T) {
+	down := errors.New("down")
+	dials := 0
+	p := NewPool(func(addr string) (*Client, error) {
+		dials++
+		return nil, down
+	}, 0, 0, WithBreaker(2, 50*time.Millisecond))
+	defer p.Close()
+
+	nop := func(c *Client) error { return nil }
+	for i, want := range []error{down, down, ErrCircuitOpen, ErrCircuitOpen} {
+		if err := p.Do("host", nop); err != want {
+			t.Errorf("attempt %d: got %v, want %v", i+1, err, want)
+		}
+	}
+	if dials != 2 {
+		t.Errorf("got %d dials, want 2", dials)
+	}
+
+	// After the cooldown a failing probe opens the breaker again
+	time.Sleep(60 * time.Millisecond)
+	if err := p.Do("host", nop); err != down {
+		t.Errorf("probe: got %v, want %v", err, down)
+	}
+	if err := p.Do("host", nop); err != ErrCircuitOpen {
+		t.Errorf("after the probe: got %v, want %v", err, ErrCircuitOpen)
+	}
+	if err := p.Do("other", nop); err != down {
+		t.Errorf("other host: got %v, want %v", err, down)
+	}
+}
+
+// A pool dialing a new test server every time, counting the dials by address
+type testDialer struct {
+	t     *testing.T
+	mu    sync.Mutex
+	dials map[string]int
+}
+
+func (d *testDialer) dial(addr string) (*Client, error) {
+	d.mu.Lock()
+	d.dials[addr]++
+	d.mu.Unlock()
+	return newTestClient(d.t), nil
+}
+
+func (d *testDialer) count(addr string) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.dials[addr]
+}
+
+func newTestDialer(t *testing.T) *testDialer {
+	return &testDialer{t: t, dials: make(map[string]int)}
+}
+
+// Run a command over the pooled connection, returning the client used
+func poolRun(t *testing.T, p *Pool, addr string) *Client {
+	t.Helper()
+	var used *Client
+	if err := p.Do(addr, func(c *Client) error {
+		used = c
+		_, _, err := c.RunCommand("true")
+		return err
+	}); err != nil {
+		t.Fatalf("%s: %v", addr, err)
+	}
+	return used
+}
+
+func TestPoolReuse(t *testing.T) {
+	d := newTestDialer(t)
+	p := NewPool(d.dial, 0, 0)
+	defer p.Close()
+
+	first := poolRun(t, p, "a")
+	if c := poolRun(t, p, "a"); c != first {
+		t.Error("got another client for the same address")
+	}
+	if c := poolRun(t, p, "b"); c == first {
+		t.Error("got the same client for another address")
+	}
+	if d.count("a") != 1 || d.count("b") != 1 {
+		t.Errorf("got %d and %d dials, want 1 each", d.count("a"), d.count("b"))
+	}
+}
+
+func TestPoolReconnect(t *testing.T) {
+	d := newTestDialer(t)
+	p := NewPool(d.dial, 0, 0)
+	defer p.Close()
+
+	// The connection drops between two uses
+	first := poolRun(t, p, "a")
+	first.SshClient.Close()
+	deadline := time.Now().Add(time.Second)
+	for {
+		p.mu.Lock()
+		_, ok := p.conns["a"]
+		p.mu.Unlock()
+		if !ok || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if c := poolRun(t, p, "a"); c == first {
+		t.Error("got the closed client again")
+	}
+
+	// The connection breaks while in use, the failing operation evicts it
+	var broken *Client
+	err := p.Do("a", func(c *Client) error {
+		broken = c
+		c.SshClient.Close()
+		_, _, err := c.RunCommand("true")
+		return err
+	})
+	if err == nil {
+		t.Fatal("got no error running a command over a closed connection")
+	}
+	if c := poolRun(t, p, "a"); c == broken {
+		t.Error("got the broken client again")
+	}
+	if d.count("a") != 3 {
+		t.Errorf("got %d dials, want 3", d.count("a"))
+	}
+}
+
+func TestPoolIdleTTL(t *testing.T) {
+	d := newTestDialer(t)
+	p := NewPool(d.dial, 0, 20*time.Millisecond)
+	defer p.Close()
+
+	first := poolRun(t, p, "a")
+	if c := poolRun(t, p, "a"); c != first {
+		t.Error("got another client before the TTL")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if c := poolRun(t, p, "a"); c == first {
+		t.Error("got the idle client again after the TTL")
+	}
+	if _, _, err := first.SshClient.SendRequest("keepalive@openssh.com", true, nil); err == nil {
+		t.Error("the expired connection is still open")
+	}
+}
+
+func TestPoolMaxOpen(t *testing.T) {
+	d := newTestDialer(t)
+	p := NewPool(d.dial, 1, 0)
+	defer p.Close()
+
+	// An idle connection is evicted to make room
+	a := poolRun(t, p, "a")
+	poolRun(t, p, "b")
+	if _, _, err := a.SshClient.SendRequest("keepalive@openssh.com", true, nil); err == nil {
+		t.Error("the idle connection wasn't closed to make room")
+	}
+
+	// With the single connection in use, the next caller waits for it to be
+	// released
+	inUse, release := make(chan struct{}), make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- p.Do("b", func(c *Client) error {
+			close(inUse)
+			<-release
+			return nil
+		})
+	}()
+	<-inUse
+	waited := make(chan *Client, 1)
+	go func() {
+		var used *Client
+		p.Do("c", func(c *Client) error {
+			used = c
+			return nil
+		})
+		waited <- used
+	}()
+	select {
+	case <-waited:
+		t.Fatal("got a connection beyond maxOpen")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case c := <-waited:
+		if c == nil {
+			t.Error("the waiting caller got no client")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the waiting caller is still waiting")
+	}
+	if d.count("c") != 1 {
+		t.Errorf("got %d dials of c, want 1", d.count("c"))
+	}
+}
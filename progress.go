@@ -0,0 +1,151 @@
+package scp
+
+import (
+	"io"
+	"time"
+)
+
+// ProgressWriter counts the bytes written through it to W, calling OnProgress
+// after every write with the count so far
+type ProgressWriter struct {
+	W io.Writer
+	// Path and Total are passed on to OnProgress
+	Path  string
+	Total int64
+	// Written is the number of bytes written so far
+	Written    int64
+	OnProgress func(path string, written, total int64)
+}
+
+func (pw *ProgressWriter) Write(p []byte) (int, error) {
+	n, err := pw.W.Write(p)
+	pw.Written += int64(n)
+	if pw.OnProgress != nil && n > 0 {
+		pw.OnProgress(pw.Path, pw.Written, pw.Total)
+	}
+	return n, err
+}
+
+// ProgressEvent describes the progress of a file transfer
+type ProgressEvent struct {
+	// Path is the local path of the file
+	Path string
+	// Bytes is the number of bytes transferred so far, out of Total
+	Bytes int64
+	Total int64
+	// Download is set when the file is being received
+	Download bool
+	// Elapsed is the time since the transfer of the file started
+	Elapsed time.Duration
+	// ETA is the estimated time left, based on an exponentially weighted
+	// moving average of the throughput. It is -1 until it can be estimated.
+	ETA time.Duration
+	// Rate is the current throughput in bytes per second, measured over the
+	// last fraction of a second
+	Rate float64
+}
+
+const (
+	// Minimum time between two throughput samples
+	rateSampleInterval = 200 * time.Millisecond
+	// Weight of the latest sample in the average
+	rateSmoothing = 0.3
+)
+
+// rateEstimator keeps a moving average of the throughput of a transfer
+type rateEstimator struct {
+	start        time.Time
+	sampled      time.Time
+	sampledBytes int64
+	// Smoothed and latest bytes per second, valid once sampled
+	rate    float64
+	current float64
+	hasRate bool
+}
+
+func newRateEstimator() *rateEstimator {
+	now := time.Now()
+	return &rateEstimator{start: now, sampled: now}
+}
+
+// Record that n bytes in total have been transferred
+func (e *rateEstimator) update(n int64) {
+	now := time.Now()
+	dt := now.Sub(e.sampled)
+	if dt < rateSampleInterval {
+		return
+	}
+
+	rate := float64(n-e.sampledBytes) / dt.Seconds()
+	e.current = rate
+	if !e.hasRate {
+		e.rate, e.hasRate = rate, true
+	} else {
+		e.rate = rateSmoothing*rate + (1-rateSmoothing)*e.rate
+	}
+	e.sampled, e.sampledBytes = now, n
+}
+
+// Estimate the time needed to transfer what is left out of total once n bytes are
+// done. Before the first sample the average since the start is used.
+func (e *rateEstimator) eta(n, total int64) time.Duration {
+	if n >= total {
+		return 0
+	}
+
+	rate := e.rate
+	if !e.hasRate {
+		rate = e.average(n)
+	}
+	if rate <= 0 {
+		return -1
+	}
+	return time.Duration(float64(total-n) / rate * float64(time.Second))
+}
+
+// Throughput over the last sample, or before the first one since the start, for
+// n bytes transferred
+func (e *rateEstimator) currentRate(n int64) float64 {
+	if e.hasRate {
+		return e.current
+	}
+	return e.average(n)
+}
+
+func (e *rateEstimator) average(n int64) float64 {
+	if elapsed := time.Since(e.start).Seconds(); elapsed > 0 {
+		return float64(n) / elapsed
+	}
+	return 0
+}
+
+// Return the function reporting the progress of a single file to the callbacks
+// set, or nil if there are none
+func (c *Client) progress(download bool) func(path string, n, total int64) {
+	cb := c.OnProgress
+	if download {
+		cb = c.OnReceiveProgress
+	}
+	if cb == nil && c.OnProgressEvent == nil {
+		return nil
+	}
+
+	e := newRateEstimator()
+	return func(path string, n, total int64) {
+		if cb != nil {
+			cb(path, n, total)
+		}
+		if c.OnProgressEvent != nil {
+			e.update(n)
+			c.OnProgressEvent(ProgressEvent{
+				Path:     path,
+				Bytes:    n,
+				Total:    total,
+				Download: download,
+				Elapsed:  time.Since(e.start),
+				ETA:      e.eta(n, total),
+				Rate:     e.currentRate(n),
+			})
+		}
+	}
+}
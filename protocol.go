@@ -0,0 +1,205 @@
+package scp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// A remote command speaking the scp protocol
+type scpSession struct {
+	session *ssh.Session
+	cmd     string
+	stdin   io.WriteCloser
+	stdout  *bufio.Reader
+	// scp reports what went wrong on stderr
+	stderr bytes.Buffer
+	done   chan error
+}
+
+// Start cmd in a new session, giving up waiting for a free one when ctx is done
+func (c *Client) startSession(ctx context.Context, cmd string) (*scpSession, error) {
+	// Create an SSH session
+	session, release, err := c.openSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ss := &scpSession{session: session, cmd: cmd, done: make(chan error, 1)}
+
+	// Setup Input strem
+	ss.stdin, err = session.StdinPipe()
+	if err != nil {
+		session.Close()
+		release()
+		return nil, errors.New("Unable to get stdin: " + err.Error())
+	}
+
+	// Setup Output strem
+	r, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		release()
+		return nil, errors.New("Unable to get Stdout: " + err.Error())
+	}
+	ss.stdout = bufio.NewReader(r)
+	session.Stderr = &ss.stderr
+
+	c.debugf("Running %s", cmd)
+	if err := session.Start(cmd); err != nil {
+		session.Close()
+		release()
+		return nil, errors.New("Failed to start: " + err.Error())
+	}
+
+	// Wait returns once the session is over, whether the command exited or
+	// the session was closed
+	go func() {
+		err := session.Wait()
+		release()
+		ss.done <- err
+	}()
+	return ss, nil
+}
+
+// Close the session as soon as ctx is done, which unblocks any pending read or
+// write, until the returned stop function is called
+func closeOnCancel(ctx context.Context, ss *scpSession) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			ss.session.Close()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// Close the stdin of a session which went through, wait for it to exit and report
+// how it did
+func (c *Client) finish(ctx context.Context, ss *scpSession) error {
+	ss.stdin.Close()
+	return commandError(ss.cmd, c.wait(ctx, ss), ss.stderr.Bytes())
+}
+
+// Give up on a session, closing it
+func (c *Client) abort(ss *scpSession) {
+	ss.session.Close()
+	<-ss.done
+}
+
+// Wait for the remote side to exit once its stdin is closed, for at most
+// WaitTimeout. A remote that doesn't make it in time gets its session closed.
+func (c *Client) wait(ctx context.Context, ss *scpSession) error {
+	// Anything the remote still has to say is of no interest
+	go io.Copy(ioutil.Discard, ss.stdout)
+
+	var timeout <-chan time.Time
+	if c.WaitTimeout > 0 {
+		t := time.NewTimer(c.WaitTimeout)
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	// Once the session is closed Wait returns promptly, and stderr is no
+	// longer written to
+	select {
+	case err := <-ss.done:
+		return err
+	case <-timeout:
+		ss.session.Close()
+		<-ss.done
+		return errors.New("Timed out waiting for the remote side to finish")
+	case <-ctx.Done():
+		ss.session.Close()
+		<-ss.done
+		return ctx.Err()
+	}
+}
+
+// An ackError is a warning or fatal error sent by the remote side in place of an
+// acknowledgement
+type ackError struct {
+	fatal bool
+	msg   string
+}
+
+func (e *ackError) Error() string {
+	return "Remote error: " + e.msg
+}
+
+// Write a record, logging it in debug mode
+func (c *Client) sendRecord(w io.Writer, record string) error {
+	c.debugf("> %s", printable(record))
+	_, err := io.WriteString(w, record)
+	return err
+}
+
+// Write a success acknowledgement, logging it in debug mode
+func (c *Client) sendAck(w io.Writer) error {
+	c.debugf("> %s", printable("\x00"))
+	return ack(w)
+}
+
+// Read an acknowledgement, logging it in debug mode
+func (c *Client) recvAck(r *bufio.Reader) error {
+	err := readAck(r)
+	if c.Debug {
+		var ae *ackError
+		switch {
+		case err == nil:
+			c.debugf("< %s", printable("\x00"))
+		case errors.As(err, &ae) && ae.fatal:
+			c.debugf("< %s", printable("\x02"+ae.msg+"\n"))
+		case errors.As(err, &ae):
+			c.debugf("< %s", printable("\x01"+ae.msg+"\n"))
+		default:
+			c.debugf("< %v", err)
+		}
+	}
+	return err
+}
+
+// Write a success acknowledgement
+func ack(w io.Writer) error {
+	_, err := w.Write([]byte{0})
+	return err
+}
+
+// Read an acknowledgement. Warnings (1) and fatal errors (2) are followed by a
+// message line and returned as an *ackError.
+func readAck(r *bufio.Reader) error {
+	b, err := r.ReadByte()
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return errors.New("Failed to read acknowledgement: " + err.Error())
+	}
+	if b == 0 {
+		return nil
+	}
+
+	line, err := r.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return errors.New("Failed to read acknowledgement: " + err.Error())
+	}
+	line = strings.TrimSuffix(line, "\n")
+
+	switch b {
+	case 1:
+		return &ackError{msg: line}
+	case 2:
+		return &ackError{fatal: true, msg: line}
+	default:
+		// Most likely something printed by the remote shell profile
+		return errors.New("Protocol error: unexpected response " + strings.TrimSpace(string(b)+line))
+	}
+}
@@ -0,0 +1,72 @@
+package scp
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Size of the chunks file bodies are copied in with a RateLimiter, when ChunkSize
+// is not set
+const rateChunkSize = 32 << 10
+
+// RateLimiter limits the rate at which Send copies file bodies, see
+// Client.RateLimiter. *rate.Limiter of golang.org/x/time/rate implements it, with
+// a burst of at least the chunk size.
+type RateLimiter interface {
+	// WaitN blocks until n bytes may be sent, or ctx is done
+	WaitN(ctx context.Context, n int) error
+}
+
+// A token bucket filled with bytes at a constant rate
+type tokenBucket struct {
+	rate  float64 // bytes per second
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a RateLimiter letting bytesPerSecond bytes through every
+// second, after an initial burst of a tenth of that. It panics if bytesPerSecond
+// is not positive, leave Client.RateLimiter unset for no limit.
+func NewRateLimiter(bytesPerSecond int64) RateLimiter {
+	if bytesPerSecond <= 0 {
+		panic("non-positive rate for NewRateLimiter")
+	}
+	burst := float64(bytesPerSecond) / 10
+	return &tokenBucket{rate: float64(bytesPerSecond), burst: burst, tokens: burst, last: time.Now()}
+}
+
+func (b *tokenBucket) WaitN(ctx context.Context, n int) error {
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	// Take the tokens right away, going into debt if needed, so that waiters
+	// get through in turn, each one waiting for its own debt to be paid
+	b.tokens -= float64(n)
+	wait := time.Duration(-b.tokens / b.rate * float64(time.Second))
+	b.mu.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		// The bytes won't be sent, give the tokens back
+		b.mu.Lock()
+		b.tokens += float64(n)
+		b.mu.Unlock()
+		return ctx.Err()
+	}
+}
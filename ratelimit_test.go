@@ -0,0 +1,39 @@
+package scp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	// 1 MB/s with a burst of 100 kB, the two files sharing the limiter take
+	// at least 200ms for their 300 kB
+	c := &Client{Options: Options{Quiet: true, RateLimiter: NewRateLimiter(1000000)}}
+	s := newTestSendState(ioutil.Discard, "")
+
+	start := time.Now()
+	for _, name := range []string{"a", "b"} {
+		body := bytes.Repeat([]byte("x"), 150000)
+		if n, err := c.copyBody(s, bytes.NewReader(body), name, int64(len(body)), make([]byte, copyBufferSize)); err != nil || n != int64(len(body)) {
+			t.Fatalf("copied %d bytes of %s: %v", n, name, err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 190*time.Millisecond || elapsed > time.Second {
+		t.Errorf("copying 300 kB at 1 MB/s took %v, want about 200ms", elapsed)
+	}
+}
+
+func TestRateLimiterNonPositive(t *testing.T) {
+	for _, rate := range []int64{0, -1} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("NewRateLimiter(%d) didn't panic", rate)
+				}
+			}()
+			NewRateLimiter(rate)
+		}()
+	}
+}
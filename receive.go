@@ -0,0 +1,455 @@
+package scp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/kballard/go-shellquote"
+)
+
+// ConflictPolicy decides what happens to a received file whose name already
+// exists in the local destination directory
+type ConflictPolicy int
+
+const (
+	// Overwrite replaces the existing file. This is what scp does
+	Overwrite ConflictPolicy = iota
+	// Skip keeps the existing file and discards the received one
+	Skip
+	// Rename keeps both, writing the received file as name.1, name.2, ...
+	Rename
+	// Fail aborts the transfer
+	Fail
+)
+
+// Form receive command based on client configuration
+func (c *Client) getReceiveCommand(paths []string) string {
+	cmd := c.scpPath() + " -rf"
+
+	if c.quiet() {
+		cmd += "q"
+	}
+
+	if c.SkipUnchanged || c.preserveTimes() {
+		cmd += "p"
+	}
+
+	if len(c.ExtraArgs) > 0 {
+		cmd += " " + shellquote.Join(c.ExtraArgs...)
+	}
+
+	return fmt.Sprintf("%s %s", cmd, quotePath(paths...))
+}
+
+// Receive the remote paths into the local dst. If dst is an existing directory the
+// paths are created inside it, otherwise a single path is received as dst itself.
+func (c *Client) Receive(dst string, paths ...string) error {
+	return c.ReceiveContext(c.context(), dst, paths...)
+}
+
+// ReceiveContext is like Receive, but gives up as soon as ctx is done, closing the
+// session. The file being received at that point is removed, or renamed with
+// KeepPartial, files received before are kept.
+func (c *Client) ReceiveContext(ctx context.Context, dst string, paths ...string) (err error) {
+	defer func() {
+		if err != nil {
+			c.logEvent(LogEvent{Event: EventError, Err: err})
+		}
+	}()
+
+	if dst == "" {
+		return errors.New("Missing local destination")
+	}
+	if len(paths) == 0 {
+		return errors.New("No remote paths to receive")
+	}
+
+	ss, err := c.startSession(ctx, c.getReceiveCommand(paths))
+	if err != nil {
+		return err
+	}
+	defer ss.session.Close()
+	defer closeOnCancel(ctx, ss)()
+
+	if err := c.receive(ss.stdout, ss.stdin, dst); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+
+	err = c.finish(ctx, ss)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// SizeLimitError is returned by ReceiveToWriterLimit when the remote file is larger
+// than allowed
+type SizeLimitError struct {
+	Path  string
+	Size  int64
+	Limit int64
+}
+
+func (e *SizeLimitError) Error() string {
+	return fmt.Sprintf("Remote file %s is %d bytes, larger than the limit of %d", e.Path, e.Size, e.Limit)
+}
+
+// ReceiveToWriterLimit copies the content of the remote file remotePath to w. If
+// the size announced by the remote side exceeds maxBytes, it gives up before
+// copying anything and returns a *SizeLimitError, which protects the memory of a
+// bytes.Buffer given as w from a remote claiming a huge file.
+func (c *Client) ReceiveToWriterLimit(w io.Writer, remotePath string, maxBytes int64) error {
+	if remotePath == "" {
+		return errors.New("No remote paths to receive")
+	}
+
+	ctx := c.context()
+	ss, err := c.startSession(ctx, c.getReceiveCommand([]string{remotePath}))
+	if err != nil {
+		return err
+	}
+	defer ss.session.Close()
+	defer closeOnCancel(ctx, ss)()
+
+	if err := c.receiveToWriter(ss.stdout, ss.stdin, w, remotePath, maxBytes); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		c.abort(ss)
+		return err
+	}
+	err = c.finish(ctx, ss)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// Receive the single file remotePath from r into out, acknowledging the records on
+// w, if it is at most maxBytes long
+func (c *Client) receiveToWriter(r *bufio.Reader, w io.Writer, out io.Writer, remotePath string, maxBytes int64) error {
+	if err := c.sendAck(w); err != nil {
+		return err
+	}
+
+	for {
+		rec, err := parseRecord(r)
+		if err == io.EOF {
+			return errors.New("Remote sent no file for " + remotePath)
+		}
+		if rec.raw != "" {
+			c.debugf("< %s", printable(rec.raw))
+		}
+		if err != nil {
+			return err
+		}
+
+		switch rec.Type {
+		case 'T':
+			if err := c.sendAck(w); err != nil {
+				return err
+			}
+		case 'C':
+			size := rec.Size
+			if size > maxBytes {
+				return &SizeLimitError{Path: remotePath, Size: size, Limit: maxBytes}
+			}
+			if err := c.sendAck(w); err != nil {
+				return err
+			}
+
+			buf := getCopyBuffer(c.BufferSize)
+			defer putCopyBuffer(buf)
+			if n, err := copyN(out, r, size, *buf); err == io.EOF {
+				return fmt.Errorf("Truncated download of %s: %d bytes received out of %d: %w",
+					remotePath, n, size, io.ErrUnexpectedEOF)
+			} else if err != nil {
+				return err
+			}
+			// The body is followed by a status byte from the source
+			if err := c.recvAck(r); err != nil {
+				return err
+			}
+			return c.sendAck(w)
+		case 'D':
+			return errors.New("Not a regular file: " + remotePath)
+		case 1, 2:
+			return errors.New("Remote error: " + rec.Message)
+		default:
+			return fmt.Errorf("Protocol error: unexpected record %q", rec.raw)
+		}
+	}
+}
+
+// ReceiveDir downloads the remote directory remoteDir and everything under it as
+// the local directory localDst, which is created if needed, or merged into if it
+// exists: remoteDir/a ends up as localDst/a. Directories and files get the modes
+// of the remote ones, and their times too with PreserveTimes. remoteDir must be a
+// directory.
+func (c *Client) ReceiveDir(localDst, remoteDir string) error {
+	if localDst == "" {
+		return errors.New("Missing local destination")
+	}
+	if remoteDir == "" {
+		return errors.New("No remote paths to receive")
+	}
+	if err := os.MkdirAll(localDst, 0755); err != nil {
+		return err
+	}
+
+	ctx := c.context()
+	ss, err := c.startSession(ctx, c.getReceiveCommand([]string{remoteDir}))
+	if err != nil {
+		return err
+	}
+	defer ss.session.Close()
+	defer closeOnCancel(ctx, ss)()
+
+	if err := c.receiveInto(ss.stdout, ss.stdin, localDst, true); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		c.abort(ss)
+		return err
+	}
+	return c.finish(ctx, ss)
+}
+
+// Run the sink side of the protocol, reading records from r and acknowledging them on w
+func (c *Client) receive(r *bufio.Reader, w io.Writer, dst string) error {
+	return c.receiveInto(r, w, dst, false)
+}
+
+// Same as receive, the top directory received being dst itself with asDst
+func (c *Client) receiveInto(r *bufio.Reader, w io.Writer, dst string, asDst bool) error {
+	var dirStack []string
+	// Times of the directories of dirStack, applied once they are complete
+	var dirTimes []*fileTimes
+	// Times of the next file or directory, from the T record preceding it
+	var times *fileTimes
+
+	// Ask the source to start sending
+	if err := c.sendAck(w); err != nil {
+		return err
+	}
+
+	for {
+		rec, err := parseRecord(r)
+		if err == io.EOF {
+			break
+		}
+		if rec.raw != "" {
+			c.debugf("< %s", printable(rec.raw))
+		}
+		if err != nil {
+			return err
+		}
+
+		switch t := rec.Type; t {
+		case 'C', 'D':
+			mode, size, name := rec.Mode, rec.Size, rec.Name
+
+			parent := dst
+			if len(dirStack) > 0 {
+				parent = dirStack[len(dirStack)-1]
+			}
+			path := filepath.Join(parent, name)
+			if len(dirStack) == 0 && asDst {
+				if t != 'D' {
+					return errors.New("Not a directory: " + name)
+				}
+				path = dst
+			} else if len(dirStack) == 0 {
+				if fi, err := os.Stat(dst); err != nil || !fi.IsDir() {
+					path = dst
+				}
+			}
+
+			ft := times
+			times = nil
+
+			if t == 'D' {
+				if err := os.Mkdir(path, mode); err != nil && !os.IsExist(err) {
+					return err
+				}
+				if err := os.Chmod(path, mode); err != nil {
+					return err
+				}
+				dirStack = append(dirStack, path)
+				dirTimes = append(dirTimes, ft)
+				c.logEvent(LogEvent{Event: EventDirEnter, Path: path})
+				if err := c.sendAck(w); err != nil {
+					return err
+				}
+				continue
+			}
+
+			if err := c.sendAck(w); err != nil {
+				return err
+			}
+			if err := c.receiveRegularFile(r, path, mode, size, ft); err != nil {
+				return err
+			}
+		case 'E':
+			if len(dirStack) == 0 {
+				return errors.New("Protocol error: unexpected E record")
+			}
+			path, ft := dirStack[len(dirStack)-1], dirTimes[len(dirTimes)-1]
+			// Creating the entries inside changed the modification time
+			if ft != nil {
+				if err := os.Chtimes(path, ft.atime, ft.mtime); err != nil {
+					return err
+				}
+			}
+			c.logEvent(LogEvent{Event: EventDirExit, Path: path})
+			dirStack, dirTimes = dirStack[:len(dirStack)-1], dirTimes[:len(dirTimes)-1]
+		case 'T':
+			times = &fileTimes{mtime: rec.Mtime, atime: rec.Atime}
+		case 1:
+			c.warnf("%s", rec.Message)
+			continue
+		case 2:
+			return errors.New("Remote error: " + rec.Message)
+		default:
+			return fmt.Errorf("Protocol error: unexpected record %q", rec.raw)
+		}
+
+		if err := c.sendAck(w); err != nil {
+			return err
+		}
+	}
+
+	if len(dirStack) > 0 {
+		return errors.New("Protocol error: missing E record")
+	}
+	return nil
+}
+
+// receive regular file body of the given size into path, honoring the conflict
+// policy. times is nil if the remote side didn't send any.
+func (c *Client) receiveRegularFile(r *bufio.Reader, path string, mode os.FileMode, size int64, times *fileTimes) error {
+	var f *os.File
+	var err error
+	start := time.Now()
+	if !c.unchanged(path, size, times) {
+		if f, err = c.createLocalFile(path, mode); err != nil {
+			return err
+		}
+	}
+
+	buf := getCopyBuffer(c.BufferSize)
+	defer putCopyBuffer(buf)
+	if f == nil {
+		// Skipped, drain the body so the stream stays in sync
+		_, err = copyN(ioutil.Discard, r, size, *buf)
+	} else {
+		c.logEvent(LogEvent{Event: EventFileStart, Path: f.Name()})
+		var w io.Writer = f
+		if report := c.progress(true); report != nil {
+			report(f.Name(), 0, size)
+			w = &ProgressWriter{W: f, Path: f.Name(), Total: size, OnProgress: report}
+		}
+		// OpenFile only applies the mode, minus the umask, to new files
+		if err = f.Chmod(mode); err == nil {
+			var n int64
+			if n, err = copyN(w, r, size, *buf); err == io.EOF {
+				err = fmt.Errorf("Truncated download of %s: %d bytes received out of %d: %w",
+					path, n, size, io.ErrUnexpectedEOF)
+			}
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+
+	// The body is followed by a status byte from the source
+	if err == nil {
+		var b byte
+		if b, err = r.ReadByte(); err == nil {
+			c.debugf("< %s", printable(string(b)))
+		}
+		if err == nil && b != 0 {
+			err = errors.New("Remote failed to send " + path)
+		}
+	}
+
+	if err != nil {
+		// Don't leave an incomplete file behind that looks like a good one
+		if f != nil {
+			c.discardPartial(f.Name())
+		}
+		return err
+	}
+
+	if f != nil && times != nil {
+		if err := os.Chtimes(f.Name(), times.atime, times.mtime); err != nil {
+			return err
+		}
+	}
+
+	if f != nil {
+		c.logEvent(LogEvent{Event: EventFileReceived, Path: f.Name(), Bytes: size, Duration: time.Since(start)})
+		c.infof("Received: %s", f.Name())
+	}
+	return nil
+}
+
+// Report whether SkipUnchanged applies to the local path, which then already has
+// the size and modification time of the file being received
+func (c *Client) unchanged(path string, size int64, times *fileTimes) bool {
+	if !c.SkipUnchanged || times == nil {
+		return false
+	}
+	fi, err := os.Stat(path)
+	return err == nil && fi.Mode().IsRegular() && fi.Size() == size && fi.ModTime().Unix() == times.mtime.Unix()
+}
+
+// Remove the incomplete file, or with KeepPartial rename it to path.partial
+func (c *Client) discardPartial(path string) {
+	if c.KeepPartial {
+		if err := os.Rename(path, path+".partial"); err == nil {
+			return
+		}
+	}
+	os.Remove(path)
+}
+
+// Create the local file according to the conflict policy. A nil file means the
+// received file must be skipped.
+func (c *Client) createLocalFile(path string, mode os.FileMode) (*os.File, error) {
+	if c.OnConflict == Overwrite {
+		return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	}
+
+	// O_EXCL makes the existence check and the creation a single atomic
+	// step, so another process can't slip a file in between
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if !os.IsExist(err) {
+		return f, err
+	}
+
+	switch c.OnConflict {
+	case Skip:
+		return nil, nil
+	case Rename:
+		for i := 1; ; i++ {
+			f, err = os.OpenFile(path+"."+strconv.Itoa(i), os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+			if !os.IsExist(err) {
+				return f, err
+			}
+		}
+	default:
+		return nil, errors.New("Local file already exists: " + path)
+	}
+}
@@ -0,0 +1,286 @@
+package scp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReceiveMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// An existing file keeps its mode through OpenFile, a new one gets the umask applied
+	existing := filepath.Join(dir, "existing")
+	if err := ioutil.WriteFile(existing, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	stream := "C0600 1 existing\nx\x00C0666 1 new\ny\x00"
+	c := &Client{Options: Options{Quiet: true}}
+	if err := c.receive(bufio.NewReader(strings.NewReader(stream)), ioutil.Discard, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]os.FileMode{"existing": 0600, "new": 0666} {
+		fi, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fi.Mode().Perm(); got != want {
+			t.Errorf("%s: got mode %#o, want %#o", name, got, want)
+		}
+	}
+}
+
+func TestReceiveTruncated(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The connection drops in the middle of the body
+	stream := "C0644 5 f\nab"
+	c := &Client{Options: Options{Quiet: true}}
+	err = c.receive(bufio.NewReader(strings.NewReader(stream)), ioutil.Discard, dir)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("got error %v, want io.ErrUnexpectedEOF", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "f")); !os.IsNotExist(err) {
+		t.Errorf("got %v for the truncated file, want it removed", err)
+	}
+}
+
+func TestReceiveKeepPartial(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	stream := "C0644 5 f\nab"
+	c := &Client{Options: Options{Quiet: true, KeepPartial: true}}
+	if err := c.receive(bufio.NewReader(strings.NewReader(stream)), ioutil.Discard, dir); err == nil {
+		t.Error("got no error for a truncated download")
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "f.partial")); err != nil || string(data) != "ab" {
+		t.Errorf("got %q, %v for the partial file, want %q", data, err, "ab")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "f")); !os.IsNotExist(err) {
+		t.Errorf("got %v for the truncated file, want it renamed", err)
+	}
+}
+
+// Receives of a tree of many small files
+func BenchmarkReceive(b *testing.B) {
+	dir, err := ioutil.TempDir("", "scp")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var stream strings.Builder
+	body := strings.Repeat("x", 4096)
+	for i := 0; i < 50; i++ {
+		fmt.Fprintf(&stream, "C0644 %d %d\n%s\x00", len(body), i, body)
+	}
+
+	c := &Client{Options: Options{Quiet: true}}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := c.receive(bufio.NewReader(strings.NewReader(stream.String())), ioutil.Discard, dir); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestReceiveToWriterLimit(t *testing.T) {
+	c := &Client{Options: Options{Quiet: true}}
+
+	var out bytes.Buffer
+	stream := "T1 0 1 0\nC0644 3 f\nabc\x00"
+	if err := c.receiveToWriter(bufio.NewReader(strings.NewReader(stream)), ioutil.Discard, &out, "f", 3); err != nil || out.String() != "abc" {
+		t.Errorf("got %q, %v, want abc", out.String(), err)
+	}
+
+	// Nothing is read past a size over the limit
+	out.Reset()
+	stream = "C0644 1000000000 f\nabc"
+	err := c.receiveToWriter(bufio.NewReader(strings.NewReader(stream)), ioutil.Discard, &out, "f", 100)
+	var le *SizeLimitError
+	if !errors.As(err, &le) || le.Size != 1000000000 || le.Limit != 100 {
+		t.Errorf("got %v, want a *SizeLimitError", err)
+	}
+	if out.Len() > 0 {
+		t.Errorf("got %q written past the limit", out.String())
+	}
+
+	if _, err := exec.LookPath("scp"); err != nil {
+		t.Skip("scp not available")
+	}
+	rc := newTestClient(t)
+	defer rc.SshClient.Close()
+	dir, err := ioutil.TempDir("", "scp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "f")
+	if err := ioutil.WriteFile(path, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	out.Reset()
+	if err := rc.ReceiveToWriterLimit(&out, path, 7); err != nil || out.String() != "content" {
+		t.Errorf("got %q, %v, want content", out.String(), err)
+	}
+	if err := rc.ReceiveToWriterLimit(&out, path, 6); !errors.As(err, &le) {
+		t.Errorf("got %v, want a *SizeLimitError", err)
+	}
+}
+
+func TestReceiveDir(t *testing.T) {
+	// The top directory is the destination, whether it exists or not
+	for _, exists := range []bool{false, true} {
+		dir, err := ioutil.TempDir("", "scp")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		dst := filepath.Join(dir, "dst")
+		if exists {
+			if err := os.Mkdir(dst, 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		stream := "D0750 0 remote\nC0600 1 a\na\x00D0700 0 sub\nC0644 1 b\nb\x00E\nE\n"
+		c := &Client{Options: Options{Quiet: true}}
+		if err := c.receiveInto(bufio.NewReader(strings.NewReader(stream)), ioutil.Discard, dst, true); err != nil {
+			t.Fatal(err)
+		}
+		for name, want := range map[string]os.FileMode{"": os.ModeDir | 0750, "a": 0600, "sub": os.ModeDir | 0700, "sub/b": 0644} {
+			fi, err := os.Stat(filepath.Join(dst, filepath.FromSlash(name)))
+			if err != nil {
+				t.Error(err)
+				continue
+			}
+			if fi.Mode() != want {
+				t.Errorf("%q: got mode %v, want %v", name, fi.Mode(), want)
+			}
+		}
+	}
+
+	c := &Client{Options: Options{Quiet: true}}
+	if err := c.receiveInto(bufio.NewReader(strings.NewReader("C0644 1 a\na\x00")), ioutil.Discard, os.TempDir(), true); err == nil {
+		t.Error("got no error for a file")
+	}
+}
+
+func TestReceiveTimes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Each T record applies to the C or D record following it, a directory's
+	// once its entries are written
+	stream := "T1500000000 0 1500000100 0\nD0755 0 d\n" +
+		"T1400000000 0 1400000100 0\nC0644 1 a\na\x00C0644 1 b\nb\x00E\n"
+	c := &Client{Options: Options{Quiet: true, PreserveTimes: true}}
+	if cmd := c.getReceiveCommand([]string{"d"}); !strings.Contains(cmd, " -rfqp ") {
+		t.Errorf("receive command %q without -p", cmd)
+	}
+	if err := c.receive(bufio.NewReader(strings.NewReader(stream)), ioutil.Discard, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]int64{"d": 1500000000, "d/a": 1400000000} {
+		fi, err := os.Stat(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fi.ModTime().Unix(); got != want {
+			t.Errorf("%s: got mtime %d, want %d", name, got, want)
+		}
+	}
+	// b had no T record
+	if fi, err := os.Stat(filepath.Join(dir, "d", "b")); err != nil || fi.ModTime().Unix() == 1400000000 {
+		t.Errorf("b: got %v, %v, want the current time", fi, err)
+	}
+}
+
+func TestReceiveConflict(t *testing.T) {
+	if _, err := exec.LookPath("scp"); err != nil {
+		t.Skip("scp not available")
+	}
+	c := newTestClient(t)
+	defer c.SshClient.Close()
+
+	dir, err := ioutil.TempDir("", "scp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	remote := filepath.Join(dir, "remote", "f")
+	if err := os.Mkdir(filepath.Dir(remote), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(remote, []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		policy ConflictPolicy
+		// Receives in a row, then the content of each local file
+		times int
+		want  map[string]string
+		fails bool
+	}{
+		{Overwrite, 1, map[string]string{"f": "new"}, false},
+		{Skip, 1, map[string]string{"f": "old"}, false},
+		{Rename, 2, map[string]string{"f": "old", "f.1": "new", "f.2": "new"}, false},
+		{Fail, 1, map[string]string{"f": "old"}, true},
+	} {
+		local := filepath.Join(dir, fmt.Sprint("local", tc.policy))
+		if err := os.Mkdir(local, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(local, "f"), []byte("old"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		cc := c.WithOptions(Options{Quiet: true, OnConflict: tc.policy})
+		for i := 0; i < tc.times; i++ {
+			if err := cc.Receive(local, remote); (err != nil) != tc.fails {
+				t.Errorf("policy %d: got error %v, want one: %v", tc.policy, err, tc.fails)
+			}
+		}
+
+		infos, err := ioutil.ReadDir(local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(infos) != len(tc.want) {
+			t.Errorf("policy %d: got %d files, want %v", tc.policy, len(infos), tc.want)
+		}
+		for name, want := range tc.want {
+			if data, err := ioutil.ReadFile(filepath.Join(local, name)); err != nil || string(data) != want {
+				t.Errorf("policy %d: %s: got %q, %v, want %q", tc.policy, name, data, err, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package scp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Record is a record of the scp protocol as received by the sink, with the
+// fields of its type filled in
+type Record struct {
+	// Type is 'C', 'D', 'E' or 'T', or 0, 1 and 2 for an acknowledgement,
+	// a warning and an error
+	Type byte
+	// Mode, Size and Name of a C or D record
+	Mode os.FileMode
+	Size int64
+	Name string
+	// Times of a T record
+	Mtime, Atime time.Time
+	// Message of a warning or an error
+	Message string
+
+	// The record as received, for the debug log
+	raw string
+}
+
+// Read the next record from r. io.EOF is returned as is when r ends before a
+// record starts, so that the end of the stream can be told from a truncated one.
+func parseRecord(r *bufio.Reader) (Record, error) {
+	t, err := r.ReadByte()
+	if err != nil {
+		return Record{}, err
+	}
+	rec := Record{Type: t, raw: string(t)}
+	if t == 0 {
+		return rec, nil
+	}
+
+	line, err := r.ReadString('\n')
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return rec, errors.New("Unexpected end of protocol stream: " + err.Error())
+	}
+	rec.raw += line
+	line = strings.TrimSuffix(line, "\n")
+
+	switch t {
+	case 'C', 'D':
+		rec.Mode, rec.Size, rec.Name, err = parseCopyRecord(line)
+	case 'E':
+		if line != "" {
+			err = errors.New("Protocol error: malformed record E" + line)
+		}
+	case 'T':
+		var times *fileTimes
+		if times, err = parseTimeRecord(line); err == nil {
+			rec.Mtime, rec.Atime = times.mtime, times.atime
+		}
+	case 1, 2:
+		rec.Message = line
+	default:
+		err = fmt.Errorf("Protocol error: unexpected record %q", rec.raw)
+	}
+	return rec, err
+}
+
+// Access and modification times sent by the remote side before a file
+type fileTimes struct {
+	mtime, atime time.Time
+}
+
+// Parse the "mtime usec atime usec" part of a T record
+func parseTimeRecord(line string) (*fileTimes, error) {
+	parts := strings.Split(line, " ")
+	if len(parts) != 4 {
+		return nil, errors.New("Protocol error: malformed record T" + line)
+	}
+
+	var fields [4]int64
+	for i, p := range parts {
+		var err error
+		fields[i], err = strconv.ParseInt(p, 10, 64)
+		// The microseconds are below a second
+		if err != nil || !isDigits(p) || i%2 == 1 && fields[i] > 999999 {
+			return nil, errors.New("Protocol error: malformed record T" + line)
+		}
+	}
+	return &fileTimes{
+		mtime: time.Unix(fields[0], fields[1]*1000),
+		atime: time.Unix(fields[2], fields[3]*1000),
+	}, nil
+}
+
+// Parse the "mmmm size name" part of a C or D record
+func parseCopyRecord(line string) (os.FileMode, int64, string, error) {
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) != 3 {
+		return 0, 0, "", errors.New("Protocol error: malformed record " + line)
+	}
+
+	mode, err := strconv.ParseUint(parts[0], 8, 32)
+	if err != nil {
+		return 0, 0, "", errors.New("Protocol error: bad mode " + parts[0])
+	}
+
+	size, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || !isDigits(parts[1]) {
+		return 0, 0, "", errors.New("Protocol error: bad size " + parts[1])
+	}
+
+	name := parts[2]
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\") {
+		return 0, 0, "", errors.New("Protocol error: unexpected file name " + name)
+	}
+
+	return os.FileMode(mode).Perm(), size, name, nil
+}
+
+// Report whether s is a non-empty run of decimal digits, which strconv doesn't
+// check for: it takes a sign
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,37 @@
+//go:build go1.18
+// +build go1.18
+
+package scp
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// go test -fuzz FuzzParseRecord
+func FuzzParseRecord(f *testing.F) {
+	for _, s := range []string{"C0644 5 a\n", "D0755 0 d\n", "E\n", "T1 0 2 0\n", "\x00", "\x01w\n", "\x02e\n"} {
+		f.Add([]byte(s))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := bufio.NewReader(bytes.NewReader(data))
+		rec, err := parseRecord(r)
+		if err != nil {
+			return
+		}
+		if !bytes.HasPrefix(data, []byte(rec.raw)) {
+			t.Fatalf("raw record %q isn't the start of %q", rec.raw, data)
+		}
+		switch rec.Type {
+		case 'C', 'D':
+			if rec.Size < 0 || rec.Mode&^0777 != 0 || rec.Name == "" || rec.Name == "." || rec.Name == ".." || strings.ContainsAny(rec.Name, "/\\\n") {
+				t.Fatalf("%q: accepted %+v", data, rec)
+			}
+		case 'E', 'T', 0, 1, 2:
+		default:
+			t.Fatalf("%q: accepted record type %q", data, rec.Type)
+		}
+	})
+}
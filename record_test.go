@@ -0,0 +1,95 @@
+package scp
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRecord(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want Record
+	}{
+		{"C0644 5 a b\n", Record{Type: 'C', Mode: 0644, Size: 5, Name: "a b"}},
+		{"C4755 0 x\n", Record{Type: 'C', Mode: 0755, Name: "x"}},
+		{"D0700 0 dir\n", Record{Type: 'D', Mode: 0700, Name: "dir"}},
+		{"E\n", Record{Type: 'E'}},
+		{"T1600000000 0 1600000001 500000\n", Record{Type: 'T',
+			Mtime: time.Unix(1600000000, 0), Atime: time.Unix(1600000001, 500000000)}},
+		{"\x00", Record{Type: 0}},
+		{"\x01scp: a: No such file\n", Record{Type: 1, Message: "scp: a: No such file"}},
+		{"\x02\n", Record{Type: 2}},
+	} {
+		got, err := parseRecord(bufio.NewReader(strings.NewReader(tc.in)))
+		if err != nil {
+			t.Errorf("%q: %v", tc.in, err)
+			continue
+		}
+		if got.raw != tc.in {
+			t.Errorf("%q: raw record %q", tc.in, got.raw)
+		}
+		got.raw = ""
+		if !got.Mtime.Equal(tc.want.Mtime) || !got.Atime.Equal(tc.want.Atime) {
+			t.Errorf("%q: got times %v %v, want %v %v", tc.in, got.Mtime, got.Atime, tc.want.Mtime, tc.want.Atime)
+		}
+		got.Mtime, got.Atime, tc.want.Mtime, tc.want.Atime = time.Time{}, time.Time{}, time.Time{}, time.Time{}
+		if got != tc.want {
+			t.Errorf("%q: got %+v, want %+v", tc.in, got, tc.want)
+		}
+	}
+
+	for _, in := range []string{
+		"C0644 5 a",
+		"C0644 5\n",
+		"C0644 5 \n",
+		"C0648 5 a\n",
+		"C+644 5 a\n",
+		"C0644 -5 a\n",
+		"C0644 +5 a\n",
+		"C0644 5 ../a\n",
+		"C0644 5 ..\n",
+		"D0755 0 a/b\n",
+		"Ex\n",
+		"T1 0 2\n",
+		"T1 0 2 x\n",
+		"T1 1000000 2 0\n",
+		"T-1 0 2 0\n",
+		"T1  0 2 0\n",
+		"X\n",
+		"\x01truncated",
+	} {
+		if got, err := parseRecord(bufio.NewReader(strings.NewReader(in))); err == nil || err == io.EOF {
+			t.Errorf("%q: got %+v, %v, want an error", in, got, err)
+		}
+	}
+
+	// The end of the stream between records is not an error of the record
+	if _, err := parseRecord(bufio.NewReader(strings.NewReader(""))); err != io.EOF {
+		t.Errorf("empty stream: got %v, want io.EOF", err)
+	}
+}
+
+// Records following one another are read one at a time
+func TestParseRecords(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("D0755 0 d\nC0644 3 f\nabc\x00E\n"))
+	for _, want := range []byte{'D', 'C'} {
+		if rec, err := parseRecord(r); err != nil || rec.Type != want {
+			t.Fatalf("got %+v, %v, want a %c record", rec, err, want)
+		}
+	}
+	if body, _ := r.Peek(3); string(body) != "abc" {
+		t.Fatalf("record read past its line: %q", body)
+	}
+	r.Discard(3)
+	for _, want := range []byte{0, 'E'} {
+		if rec, err := parseRecord(r); err != nil || rec.Type != want {
+			t.Fatalf("got %+v, %v, want a %q record", rec, err, want)
+		}
+	}
+	if _, err := parseRecord(r); err != io.EOF {
+		t.Errorf("got %v at the end, want io.EOF", err)
+	}
+}
@@ -0,0 +1,481 @@
+package scp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/kballard/go-shellquote"
+	"golang.org/x/crypto/ssh"
+)
+
+// Exit statuses used by the remote commands below to report a missing path, or
+// one which is not a directory
+const (
+	notExistStatus = 44
+	notDirStatus   = 45
+)
+
+// Quote the remote paths for the remote shell. A path starting with a dash gets
+// a ./ prefix, so that commands such as scp and find, which can't all be told
+// where their options end, don't mistake it for an option.
+func quotePath(paths ...string) string {
+	quoted := make([]string, len(paths))
+	for i, p := range paths {
+		if strings.HasPrefix(p, "-") {
+			p = "./" + p
+		}
+		quoted[i] = shellquote.Join(p)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// fileInfo describes a remote file
+type fileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return fi.size }
+func (fi *fileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi *fileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *fileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *fileInfo) Sys() interface{}   { return nil }
+
+// CommandError is returned by RunCommand when the remote command doesn't exit
+// successfully
+type CommandError struct {
+	Command string
+	// ExitStatus is -1 when the command didn't report one, for instance
+	// because it was killed by a signal
+	ExitStatus int
+	Stderr     []byte
+	// Err is the underlying *ssh.ExitError or *ssh.ExitMissingError
+	Err error
+}
+
+func (e *CommandError) Error() string {
+	msg := "Remote command failed"
+	if e.ExitStatus >= 0 {
+		msg += " with status " + strconv.Itoa(e.ExitStatus)
+	}
+	if stderr := strings.TrimSpace(string(e.Stderr)); stderr != "" {
+		msg += ": " + stderr
+	}
+	return msg
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+// RunCommand runs cmd on the remote side in a new session of the client's
+// connection and returns what it wrote to stdout and stderr. If the command
+// doesn't exit successfully the error is a *CommandError.
+func (c *Client) RunCommand(cmd string) (stdout, stderr []byte, err error) {
+	return c.runCommand(cmd, nil)
+}
+
+// Same as RunCommand, feeding the command stdin when not nil
+func (c *Client) runCommand(cmd string, stdin io.Reader) (stdout, stderr []byte, err error) {
+	session, release, err := c.openSession(c.context())
+	if err != nil {
+		return nil, nil, err
+	}
+	defer release()
+	defer session.Close()
+
+	var outBuf, errBuf bytes.Buffer
+	session.Stdin = stdin
+	session.Stdout = &outBuf
+	session.Stderr = &errBuf
+
+	err = commandError(cmd, session.Run(cmd), errBuf.Bytes())
+	return outBuf.Bytes(), errBuf.Bytes(), err
+}
+
+// Turn the error of a finished session into a *CommandError, when it is about the
+// command exiting unsuccessfully
+func commandError(cmd string, err error, stderr []byte) error {
+	switch e := err.(type) {
+	case *ssh.ExitError:
+		return &CommandError{Command: cmd, ExitStatus: e.ExitStatus(), Stderr: stderr, Err: e}
+	case *ssh.ExitMissingError:
+		return &CommandError{Command: cmd, ExitStatus: -1, Stderr: stderr, Err: e}
+	}
+	return err
+}
+
+// Find which of the regular files Send would create under dst already exist on the
+// remote side. All of them are checked by a single remote command which reads the
+// names, relative to dst, from its stdin. Names containing a newline can't be
+// passed that way and are assumed not to exist.
+func (c *Client) existingRemoteFiles(dst string, sources []Source) (map[string]bool, error) {
+	var names bytes.Buffer
+	for _, src := range sources {
+		err := src.Walk(func(path, remotePath string, info os.FileInfo) error {
+			if info.Mode().IsRegular() && !strings.Contains(remotePath, "\n") {
+				names.WriteString(remotePath + "\n")
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if names.Len() == 0 {
+		return nil, nil
+	}
+
+	// When dst is not a directory the single file being sent replaces dst
+	// itself, so every name conflicts
+	q := quotePath(dst)
+	cmd := "if [ -d " + q + " ]; then cd -- " + q + " || exit 1; " +
+		"elif [ -e " + q + " ]; then cat; exit 0; else exit 0; fi; " +
+		"while IFS= read -r f; do if [ -e \"$f\" ]; then printf '%s\\n' \"$f\"; fi; done"
+
+	out, _, err := c.runCommand(cmd, &names)
+	if err != nil {
+		return nil, errors.New("Failed to check remote files: " + err.Error())
+	}
+
+	existing := make(map[string]bool)
+	for _, name := range strings.Split(string(out), "\n") {
+		if name != "" {
+			existing[name] = true
+		}
+	}
+	return existing, nil
+}
+
+// Rename the given remote files, relative to dst, to name+BackupSuffix with a single
+// remote command
+func (c *Client) backupRemoteFiles(dst string, names map[string]bool) error {
+	if len(names) == 0 {
+		return nil
+	}
+
+	suffix := c.BackupSuffix
+	if suffix == "" {
+		suffix = ".bak"
+	}
+
+	var list bytes.Buffer
+	for name := range names {
+		list.WriteString(name + "\n")
+	}
+
+	q := quotePath(dst)
+	s := shellquote.Join(suffix)
+	cmd := "if [ -d " + q + " ]; then cd -- " + q + " || exit 1; " +
+		"else exec mv -f -- " + q + " " + quotePath(dst+suffix) + "; fi; " +
+		"while IFS= read -r f; do mv -f -- \"$f\" \"$f\"" + s + " || exit 1; done"
+
+	if _, _, err := c.runCommand(cmd, &list); err != nil {
+		return errors.New("Failed to back up remote files: " + err.Error())
+	}
+	return nil
+}
+
+// Replace a leading ~ in the remote path p by the remote home directory and, with
+// ExpandEnv, the variables by their remote values, with a single remote command.
+// Paths are quoted in remote commands, so the remote shell never expands them.
+// Other users' homes, as in ~user, are left alone.
+func (c *Client) expandRemotePath(p string) (string, error) {
+	var names []string
+	var invalid string
+	if c.ExpandEnv {
+		os.Expand(p, func(name string) string {
+			if !validEnvName(name) && invalid == "" {
+				invalid = name
+			}
+			names = append(names, name)
+			return ""
+		})
+	}
+	if invalid != "" {
+		return "", errors.New("Unsupported variable in remote path: " + invalid)
+	}
+	home := p == "~" || strings.HasPrefix(p, "~/")
+	if home {
+		names = append(names, "HOME")
+	}
+	if len(names) == 0 {
+		return p, nil
+	}
+
+	// Only the values of the variables go through the shell, each prefixed
+	// with = when set. The names are safe to put in the command as they
+	// were checked to be plain identifiers.
+	cmd := "printf '%s%s\\0'"
+	for _, name := range names {
+		cmd += ` "${` + name + `+=}" "$` + name + `"`
+	}
+	out, _, err := c.RunCommand(cmd)
+	if err != nil {
+		return "", errors.New("Failed to expand the remote path: " + err.Error())
+	}
+	values := make(map[string]string)
+	for i, v := range strings.Split(string(out), "\x00") {
+		if i < len(names) {
+			if !strings.HasPrefix(v, "=") {
+				return "", errors.New("Remote variable " + names[i] + " is not set")
+			}
+			values[names[i]] = v[1:]
+		}
+	}
+
+	rest := p
+	if home {
+		rest = p[1:]
+	}
+	if c.ExpandEnv {
+		rest = os.Expand(rest, func(name string) string { return values[name] })
+	}
+	if home {
+		if values["HOME"] == "" {
+			return "", errors.New("Failed to find the remote home directory")
+		}
+		return path.Join(values["HOME"], rest), nil
+	}
+	return rest, nil
+}
+
+// Report whether name is a variable name os.Expand and the shell agree on
+func validEnvName(name string) bool {
+	for i, r := range name {
+		if r != '_' && !(r >= 'a' && r <= 'z') && !(r >= 'A' && r <= 'Z') && !(i > 0 && r >= '0' && r <= '9') {
+			return false
+		}
+	}
+	return name != ""
+}
+
+// Stat returns a FileInfo describing the remote file, following symlinks. It runs
+// GNU stat on the remote side. A missing file yields an error satisfying
+// os.IsNotExist.
+func (c *Client) Stat(remotePath string) (os.FileInfo, error) {
+	q := quotePath(remotePath)
+	out, _, err := c.RunCommand(fmt.Sprintf("test -e %s || exit %d; exec stat -L -c '%%s %%f %%Y' -- %s",
+		q, notExistStatus, q))
+	if err != nil {
+		return nil, remotePathError("stat", remotePath, err)
+	}
+
+	fields := strings.Fields(string(out))
+	if len(fields) != 3 {
+		return nil, errors.New("Unexpected stat output: " + string(out))
+	}
+	size, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return nil, errors.New("Unexpected stat output: " + string(out))
+	}
+	mode, err := strconv.ParseUint(fields[1], 16, 32)
+	if err != nil {
+		return nil, errors.New("Unexpected stat output: " + string(out))
+	}
+	mtime, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return nil, errors.New("Unexpected stat output: " + string(out))
+	}
+
+	return &fileInfo{
+		name:    path.Base(remotePath),
+		size:    size,
+		mode:    unixMode(uint32(mode)),
+		modTime: time.Unix(mtime, 0),
+	}, nil
+}
+
+// Exists reports whether the remote path exists, following symlinks, by running
+// test -e. Failing to find out, because of a connection problem for instance, is
+// reported as an error rather than as false.
+func (c *Client) Exists(remotePath string) (bool, error) {
+	_, _, err := c.RunCommand("test -e " + quotePath(remotePath))
+	if err == nil {
+		return true, nil
+	}
+
+	var cmdErr *CommandError
+	if errors.As(err, &cmdErr) && cmdErr.ExitStatus == 1 {
+		return false, nil
+	}
+	return false, remotePathError("exists", remotePath, err)
+}
+
+// Remove removes the remote file or empty directory. The path is removed with
+// rm, or rmdir for a directory, and the remote error is returned on failure.
+func (c *Client) Remove(remotePath string) error {
+	q := quotePath(remotePath)
+	_, _, err := c.RunCommand(fmt.Sprintf("if [ -d %s ] && [ ! -L %s ]; then exec rmdir -- %s; fi; "+
+		"[ -e %s ] || [ -L %s ] || exit %d; exec rm -- %s", q, q, q, q, q, notExistStatus, q))
+	if err != nil {
+		return remotePathError("remove", remotePath, err)
+	}
+	return nil
+}
+
+// RemoveAll removes the remote path and everything it contains with rm -rf. Like
+// os.RemoveAll it returns nil if the path doesn't exist.
+func (c *Client) RemoveAll(remotePath string) error {
+	if _, _, err := c.RunCommand("exec rm -rf -- " + quotePath(remotePath)); err != nil {
+		return remotePathError("remove", remotePath, err)
+	}
+	return nil
+}
+
+// Mkdir creates the remote directory with mkdir and gives it perm with a chmod,
+// so the remote umask doesn't get in the way
+func (c *Client) Mkdir(remotePath string, perm os.FileMode) error {
+	q := quotePath(remotePath)
+	_, _, err := c.RunCommand(fmt.Sprintf("mkdir -- %s && exec chmod -- %04o %s", q, unixPerm(perm), q))
+	if err != nil {
+		return remotePathError("mkdir", remotePath, err)
+	}
+	return nil
+}
+
+// MkdirAll creates the remote directory along with any missing parents, using
+// mkdir -p, and gives the directory perm with a chmod. Like os.MkdirAll it does
+// nothing if the directory already exists.
+func (c *Client) MkdirAll(remotePath string, perm os.FileMode) error {
+	q := quotePath(remotePath)
+	_, _, err := c.RunCommand(fmt.Sprintf("[ -d %s ] && exit 0; mkdir -p -- %s && exec chmod -- %04o %s",
+		q, q, unixPerm(perm), q))
+	if err != nil {
+		return remotePathError("mkdir", remotePath, err)
+	}
+	return nil
+}
+
+// Append copies everything read from r to the end of the remote file, which is
+// created if missing. SCP can only replace files, so this runs cat >> on the
+// remote side instead.
+func (c *Client) Append(remotePath string, r io.Reader) error {
+	_, _, err := c.runCommand("cat >> "+quotePath(remotePath), r)
+	if err != nil {
+		return remotePathError("append", remotePath, err)
+	}
+	return nil
+}
+
+// List returns the entries of the remote directory sorted by name, like
+// ioutil.ReadDir. Symlinks are reported as such, not followed. It runs GNU find
+// on the remote side. A missing directory yields an error satisfying
+// os.IsNotExist, while a path which is not a directory yields syscall.ENOTDIR.
+func (c *Client) List(remoteDir string) ([]os.FileInfo, error) {
+	q := quotePath(remoteDir)
+	out, _, err := c.RunCommand(fmt.Sprintf("if [ ! -d %s ]; then [ -e %s ] && exit %d; exit %d; fi; "+
+		"exec find %s -mindepth 1 -maxdepth 1 -printf '%%s %%m %%T@ %%y %%f\\0'", q, q, notDirStatus, notExistStatus, q))
+	if err != nil {
+		return nil, remotePathError("list", remoteDir, err)
+	}
+
+	// Names may contain anything but / and NUL, so entries are NUL separated
+	// and the name comes last
+	var list []os.FileInfo
+	for _, entry := range strings.Split(string(out), "\x00") {
+		if entry == "" {
+			continue
+		}
+		fi, err := parseFindEntry(entry)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, fi)
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Name() < list[j].Name() })
+	return list, nil
+}
+
+// Parse an entry printed by find -printf '%s %m %T@ %y %f'
+func parseFindEntry(entry string) (*fileInfo, error) {
+	fields := strings.SplitN(entry, " ", 5)
+	if len(fields) != 5 {
+		return nil, errors.New("Unexpected find output: " + entry)
+	}
+
+	size, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return nil, errors.New("Unexpected find output: " + entry)
+	}
+	perm, err := strconv.ParseUint(fields[1], 8, 32)
+	if err != nil {
+		return nil, errors.New("Unexpected find output: " + entry)
+	}
+	// %T@ has a fractional part
+	mtime, err := strconv.ParseInt(strings.SplitN(fields[2], ".", 2)[0], 10, 64)
+	if err != nil {
+		return nil, errors.New("Unexpected find output: " + entry)
+	}
+
+	types := map[string]uint32{
+		"f": 0100000, "d": 0040000, "l": 0120000, "p": 0010000,
+		"s": 0140000, "c": 0020000, "b": 0060000,
+	}
+
+	return &fileInfo{
+		name:    fields[4],
+		size:    size,
+		mode:    unixMode(types[fields[3]] | uint32(perm)),
+		modTime: time.Unix(mtime, 0),
+	}, nil
+}
+
+// Wrap the error of a remote command operating on a path, translating the not
+// exist status
+func remotePathError(op, remotePath string, err error) error {
+	var cmdErr *CommandError
+	if errors.As(err, &cmdErr) {
+		switch cmdErr.ExitStatus {
+		case notExistStatus:
+			err = os.ErrNotExist
+		case notDirStatus:
+			err = syscall.ENOTDIR
+		}
+	}
+	return &os.PathError{Op: op, Path: remotePath, Err: err}
+}
+
+// Convert a unix st_mode to an os.FileMode
+func unixMode(m uint32) os.FileMode {
+	mode := os.FileMode(m & 0777)
+
+	switch m & 0170000 {
+	case 0040000:
+		mode |= os.ModeDir
+	case 0120000:
+		mode |= os.ModeSymlink
+	case 0010000:
+		mode |= os.ModeNamedPipe
+	case 0140000:
+		mode |= os.ModeSocket
+	case 0020000:
+		mode |= os.ModeDevice | os.ModeCharDevice
+	case 0060000:
+		mode |= os.ModeDevice
+	}
+
+	if m&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if m&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if m&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
@@ -0,0 +1,539 @@
+package scp
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Start an in-process SSH server running exec requests with the local sh, and
+// return a Client connected to it, which the caller must close. The remote side
+// is the local machine.
+func newTestClient(t testing.TB) *Client {
+	t.Helper()
+	return newLimitedTestClient(t, 0, nil)
+}
+
+// Same as newTestClient, with a server refusing sessions beyond maxSessions when
+// set, counting the refusals in refused
+func newLimitedTestClient(t testing.TB, maxSessions int32, refused *int32) *Client {
+	t.Helper()
+	addr := startTestServer(t, maxSessions, refused)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewClientFromConn(conn, addr, &ssh.ClientConfig{
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Quiet = true
+	return c
+}
+
+// Start the server of newLimitedTestClient, taking a single connection, and return
+// its address
+func startTestServer(t testing.TB, maxSessions int32, refused *int32) string {
+	t.Helper()
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not available")
+	}
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConfig := &ssh.ServerConfig{NoClientAuth: true}
+	serverConfig.AddHostKey(signer)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		defer l.Close()
+		if nc, err := l.Accept(); err == nil {
+			serveTestConn(nc, serverConfig, maxSessions, refused)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func serveTestConn(nc net.Conn, config *ssh.ServerConfig, maxSessions int32, refused *int32) {
+	_, chans, reqs, err := ssh.NewServerConn(nc, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	var open int32
+	for newChan := range chans {
+		if newChan.ChannelType() != "session" {
+			newChan.Reject(ssh.UnknownChannelType, "unsupported channel type")
+			continue
+		}
+		if maxSessions > 0 && atomic.AddInt32(&open, 1) > maxSessions {
+			atomic.AddInt32(&open, -1)
+			atomic.AddInt32(refused, 1)
+			newChan.Reject(ssh.Prohibited, "open failed")
+			continue
+		}
+		ch, chReqs, err := newChan.Accept()
+		if err != nil {
+			continue
+		}
+		go serveTestSession(ch, chReqs, func() {
+			if maxSessions > 0 {
+				atomic.AddInt32(&open, -1)
+			}
+		})
+	}
+}
+
+// Run the session, calling done just before closing it
+func serveTestSession(ch ssh.Channel, reqs <-chan *ssh.Request, done func()) {
+	defer ch.Close()
+	defer done()
+	for req := range reqs {
+		if req.Type != "exec" {
+			req.Reply(false, nil)
+			continue
+		}
+
+		var payload struct{ Command string }
+		if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+			req.Reply(false, nil)
+			continue
+		}
+		req.Reply(true, nil)
+
+		// Copy stdin by hand, exec would otherwise wait for the client to
+		// close it even after the command is done
+		cmd := exec.Command("sh", "-c", payload.Command)
+		cmd.Stdout = ch
+		cmd.Stderr = ch.Stderr()
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			return
+		}
+		go func() {
+			io.Copy(stdin, ch)
+			stdin.Close()
+		}()
+
+		status := 0
+		if err := cmd.Run(); err != nil {
+			status = 255
+			if exitErr, ok := err.(*exec.ExitError); ok {
+				status = exitErr.ExitCode()
+			}
+		}
+		ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(status)}))
+		return
+	}
+}
+
+// Names which break naive quoting of remote commands
+var awkwardNames = []string{
+	"with space",
+	"it's",
+	`double"quote`,
+	"$(touch pwned)",
+	"`touch pwned`",
+	"semi; touch pwned",
+	"-rf",
+	"*",
+}
+
+func TestRemove(t *testing.T) {
+	c := newTestClient(t)
+	defer c.SshClient.Close()
+
+	dir, err := ioutil.TempDir("", "scp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keep := filepath.Join(dir, "keep")
+	if err := ioutil.WriteFile(keep, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range awkwardNames {
+		file := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Remove(file); err != nil {
+			t.Errorf("Remove(%q): %v", name, err)
+		}
+
+		tree := filepath.Join(dir, name+".d")
+		if err := os.MkdirAll(filepath.Join(tree, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Remove(tree); err == nil {
+			t.Errorf("Remove(%q): removed a non-empty directory", name+".d")
+		}
+		if err := c.RemoveAll(tree); err != nil {
+			t.Errorf("RemoveAll(%q): %v", name+".d", err)
+		}
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "keep" {
+		var names []string
+		for _, fi := range entries {
+			names = append(names, fi.Name())
+		}
+		t.Errorf("got %q left in the directory, want only keep", names)
+	}
+	if _, err := os.Stat("pwned"); err == nil {
+		os.Remove("pwned")
+		t.Error("a file name was run as a command")
+	}
+
+	if err := c.Remove(filepath.Join(dir, "missing")); !os.IsNotExist(err) {
+		t.Errorf("Remove of a missing file: got %v, want a not exist error", err)
+	}
+	if err := c.RemoveAll(filepath.Join(dir, "missing")); err != nil {
+		t.Errorf("RemoveAll of a missing file: %v", err)
+	}
+}
+
+func TestExpandRemotePath(t *testing.T) {
+	c := newTestClient(t)
+	defer c.SshClient.Close()
+
+	os.Setenv("SCP_TEST_DIR", "/srv/$(touch pwned)")
+	defer os.Unsetenv("SCP_TEST_DIR")
+	os.Unsetenv("SCP_TEST_UNSET")
+	home := os.Getenv("HOME")
+
+	for p, want := range map[string]string{
+		"~/app":                  home + "/app",
+		"~":                      home,
+		"~user/app":              "~user/app",
+		"$SCP_TEST_DIR/app":      "$SCP_TEST_DIR/app",
+		"/tmp/$(touch pwned)/$x": "/tmp/$(touch pwned)/$x",
+	} {
+		if got, err := c.expandRemotePath(p); err != nil || got != want {
+			t.Errorf("%s: got %q, %v, want %q", p, got, err, want)
+		}
+	}
+
+	c.ExpandEnv = true
+	for p, want := range map[string]string{
+		"$SCP_TEST_DIR/app":   "/srv/$(touch pwned)/app",
+		"${SCP_TEST_DIR}/app": "/srv/$(touch pwned)/app",
+		"~/$SCP_TEST_DIR":     home + "/srv/$(touch pwned)",
+		"/tmp/$(touch pwned)": "/tmp/$(touch pwned)",
+	} {
+		if got, err := c.expandRemotePath(p); err != nil || got != want {
+			t.Errorf("%s: got %q, %v, want %q", p, got, err, want)
+		}
+	}
+	for _, p := range []string{"$SCP_TEST_UNSET/app", "${SCP_TEST_DIR:-x}"} {
+		if got, err := c.expandRemotePath(p); err == nil {
+			t.Errorf("%s: got %q, want an error", p, got)
+		}
+	}
+	if _, err := os.Stat("pwned"); err == nil {
+		os.Remove("pwned")
+		t.Error("a remote path was run as a command")
+	}
+}
+
+func TestAwkwardPaths(t *testing.T) {
+	if _, err := exec.LookPath("scp"); err != nil {
+		t.Skip("scp not available")
+	}
+	c := newTestClient(t)
+	defer c.SshClient.Close()
+
+	dir, err := ioutil.TempDir("", "scp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	local := filepath.Join(dir, "local")
+
+	for _, name := range append(awkwardNames, "foo; rm -rf /") {
+		remote := filepath.Join(dir, name)
+		if err := c.MkdirAll(remote, 0755); err != nil {
+			t.Errorf("MkdirAll(%q): %v", name, err)
+			continue
+		}
+		if fi, err := c.Stat(remote); err != nil || !fi.IsDir() {
+			t.Errorf("Stat(%q): got %v, %v, want a directory", name, fi, err)
+		}
+		if err := c.SendReader(remote, "f", strings.NewReader("x"), 1, 0644); err != nil {
+			t.Errorf("SendReader(%q): %v", name, err)
+		}
+		if err := c.Append(filepath.Join(remote, "f"), strings.NewReader("y")); err != nil {
+			t.Errorf("Append(%q): %v", name, err)
+		}
+		if entries, err := c.List(remote); err != nil || len(entries) != 1 || entries[0].Size() != 2 {
+			t.Errorf("List(%q): got %v, %v, want f of 2 bytes", name, entries, err)
+		}
+
+		if err := os.RemoveAll(local); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Mkdir(local, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Receive(local, filepath.Join(remote, "f")); err != nil {
+			t.Errorf("Receive(%q): %v", name, err)
+		}
+		if data, err := ioutil.ReadFile(filepath.Join(local, "f")); err != nil || string(data) != "xy" {
+			t.Errorf("Receive(%q): got %q, %v, want xy", name, data, err)
+		}
+
+		if err := c.RemoveAll(remote); err != nil {
+			t.Errorf("RemoveAll(%q): %v", name, err)
+		}
+		if ok, err := c.Exists(remote); err != nil || ok {
+			t.Errorf("Exists(%q) after RemoveAll: got %v, %v", name, ok, err)
+		}
+	}
+
+	if _, err := os.Stat("pwned"); err == nil {
+		os.Remove("pwned")
+		t.Error("a path was run as a command")
+	}
+}
+
+func TestMaxSessions(t *testing.T) {
+	// Run commands outlasting each other on a server taking two sessions
+	run := func(c *Client) (failed int) {
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		for i := 0; i < 6; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, _, err := c.RunCommand("sleep 0.1"); err != nil {
+					mu.Lock()
+					failed++
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		return failed
+	}
+
+	// Refused sessions are tried again
+	var refused int32
+	c := newLimitedTestClient(t, 2, &refused)
+	defer c.SshClient.Close()
+	if failed := run(c); failed > 0 || refused == 0 {
+		t.Errorf("got %d failures and %d refusals, want none and some", failed, refused)
+	}
+	c.SessionWait = -1
+	if failed := run(c); failed == 0 {
+		t.Error("got no failures without SessionWait")
+	}
+
+	// Or never refused
+	refused = 0
+	c = newLimitedTestClient(t, 2, &refused)
+	defer c.SshClient.Close()
+	c.MaxSessions = 2
+	if failed := run(c.WithOptions(c.Options)); failed > 0 || refused > 0 {
+		t.Errorf("got %d failures and %d refusals with MaxSessions, want none", failed, refused)
+	}
+}
+
+func TestMaxSessionsCancel(t *testing.T) {
+	c := newTestClient(t)
+	defer c.SshClient.Close()
+	c.MaxSessions = 1
+
+	// Hold the single session
+	_, release, err := c.openSession(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	start := time.Now()
+	if _, _, err := c.openSession(ctx); err != context.Canceled {
+		t.Errorf("got %v waiting for a session, want context.Canceled", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("gave up after %v", elapsed)
+	}
+
+	// The Context of the options stops the methods not taking one
+	cc := c.WithOptions(Options{Quiet: true, MaxSessions: 1, Context: ctx})
+	if _, _, err := cc.RunCommand("true"); err != context.Canceled {
+		t.Errorf("RunCommand: got %v, want context.Canceled", err)
+	}
+}
+
+// Create the awkward files, and fresh, in a new directory under dir holding data
+func writeAwkwardFiles(t *testing.T, dir, name string, fresh bool, data string) (string, []string) {
+	t.Helper()
+	d := filepath.Join(dir, name)
+	if err := os.Mkdir(d, 0755); err != nil {
+		t.Fatal(err)
+	}
+	names := awkwardNames
+	if fresh {
+		names = append(names[:len(names):len(names)], "fresh")
+	}
+	var paths []string
+	for _, n := range names {
+		p := filepath.Join(d, n)
+		if err := ioutil.WriteFile(p, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, p)
+	}
+	return d, paths
+}
+
+// Check the content of the files of dir, by name, and that there are no others
+func checkFiles(t *testing.T, dir string, want map[string]string) {
+	t.Helper()
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != len(want) {
+		var got []string
+		for _, fi := range infos {
+			got = append(got, fi.Name())
+		}
+		t.Errorf("%s: got files %q, want %d", dir, got, len(want))
+	}
+	for name, data := range want {
+		if got, err := ioutil.ReadFile(filepath.Join(dir, name)); err != nil || string(got) != data {
+			t.Errorf("%s: got %q, %v, want %q", name, got, err, data)
+		}
+	}
+}
+
+func TestSendOverwritePolicy(t *testing.T) {
+	if _, err := exec.LookPath("scp"); err != nil {
+		t.Skip("scp not available")
+	}
+	c := newTestClient(t)
+	defer c.SshClient.Close()
+
+	for _, policy := range []ConflictPolicy{Skip, Fail} {
+		dir, err := ioutil.TempDir("", "scp")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		_, paths := writeAwkwardFiles(t, dir, "src", true, "new")
+		dst, _ := writeAwkwardFiles(t, dir, "dst", false, "old")
+
+		err = c.WithOptions(Options{Quiet: true, SendOverwritePolicy: policy}).Send(dst, paths...)
+		want := make(map[string]string)
+		for _, name := range awkwardNames {
+			want[name] = "old"
+		}
+		if policy == Skip {
+			// Only the missing file is sent
+			if err != nil {
+				t.Errorf("Skip: %v", err)
+			}
+			want["fresh"] = "new"
+		} else if err == nil {
+			t.Error("Fail: got no error with existing remote files")
+		}
+		checkFiles(t, dst, want)
+	}
+
+	if _, err := os.Stat("pwned"); err == nil {
+		os.Remove("pwned")
+		t.Error("a name was run as a command")
+	}
+}
+
+func TestSendBackup(t *testing.T) {
+	if _, err := exec.LookPath("scp"); err != nil {
+		t.Skip("scp not available")
+	}
+	c := newTestClient(t)
+	defer c.SshClient.Close()
+
+	for _, suffix := range []string{"", ".o'ld $(touch pwned)"} {
+		dir, err := ioutil.TempDir("", "scp")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		_, paths := writeAwkwardFiles(t, dir, "src", true, "new")
+		dst, _ := writeAwkwardFiles(t, dir, "dst", false, "old")
+
+		cc := c.WithOptions(Options{Quiet: true, Backup: true, BackupSuffix: suffix})
+		if err := cc.Send(dst, paths...); err != nil {
+			t.Fatal(err)
+		}
+		if suffix == "" {
+			suffix = ".bak"
+		}
+		// Only the files which existed are backed up
+		want := map[string]string{"fresh": "new"}
+		for _, name := range awkwardNames {
+			want[name] = "new"
+			want[name+suffix] = "old"
+		}
+		checkFiles(t, dst, want)
+	}
+
+	// A single file sent as dst itself
+	dir, err := ioutil.TempDir("", "scp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	_, paths := writeAwkwardFiles(t, dir, "src", false, "new")
+	dst := filepath.Join(dir, "it's here")
+	if err := ioutil.WriteFile(dst, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.WithOptions(Options{Quiet: true, Backup: true}).Send(dst, paths[0]); err != nil {
+		t.Fatal(err)
+	}
+	for p, want := range map[string]string{dst: "new", dst + ".bak": "old"} {
+		if got, err := ioutil.ReadFile(p); err != nil || string(got) != want {
+			t.Errorf("%s: got %q, %v, want %q", p, got, err, want)
+		}
+	}
+
+	if _, err := os.Stat("pwned"); err == nil {
+		os.Remove("pwned")
+		t.Error("a name was run as a command")
+	}
+}
@@ -0,0 +1,93 @@
+package scp
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Retry runs an operation again when it fails, waiting longer after each attempt.
+// The zero value retries forever, without waiting.
+type Retry struct {
+	// InitialInterval is the wait after the first failure, each following one
+	// is Multiplier times longer, up to MaxInterval when it is not zero
+	InitialInterval time.Duration
+	MaxInterval     time.Duration
+	Multiplier      float64
+	// Jitter randomizes each wait by up to that fraction of it, in either
+	// direction, so that clients failing together don't all retry together
+	Jitter float64
+	// MaxElapsedTime stops retrying once the next attempt would start that
+	// long after the first one. Zero means no limit.
+	MaxElapsedTime time.Duration
+	// MaxAttempts stops retrying after that many attempts. Zero means no limit.
+	MaxAttempts int
+}
+
+// DefaultRetry waits 1s after the first failure, doubling up to 30s with a 50%
+// jitter, and gives up after 5 minutes
+var DefaultRetry = Retry{
+	InitialInterval: time.Second,
+	MaxInterval:     30 * time.Second,
+	Multiplier:      2,
+	Jitter:          0.5,
+	MaxElapsedTime:  5 * time.Minute,
+}
+
+// Shared source of the jitter, seeded so that processes don't all draw the same
+var jitterRand = struct {
+	sync.Mutex
+	*rand.Rand
+}{Rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+// Do runs op until it succeeds, the limits of r are reached or ctx is done, and
+// returns the error of the last attempt. op is given ctx, to pass on to
+// SendContext or ReceiveContext for instance.
+func (r Retry) Do(ctx context.Context, op func(ctx context.Context) error) error {
+	start := time.Now()
+	interval := r.InitialInterval
+
+	for attempt := 1; ; attempt++ {
+		err := op(ctx)
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+		if r.MaxAttempts > 0 && attempt >= r.MaxAttempts {
+			return err
+		}
+
+		wait := r.jitter(interval)
+		if r.MaxElapsedTime > 0 && time.Since(start)+wait > r.MaxElapsedTime {
+			return err
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+
+		if r.Multiplier > 0 {
+			interval = time.Duration(float64(interval) * r.Multiplier)
+		}
+		if r.MaxInterval > 0 && interval > r.MaxInterval {
+			interval = r.MaxInterval
+		}
+	}
+}
+
+// Randomize interval by the jitter fraction
+func (r Retry) jitter(interval time.Duration) time.Duration {
+	if r.Jitter <= 0 || interval <= 0 {
+		return interval
+	}
+
+	jitterRand.Lock()
+	f := jitterRand.Float64()
+	jitterRand.Unlock()
+
+	return time.Duration(float64(interval) * (1 + r.Jitter*(2*f-1)))
+}
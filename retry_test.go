@@ -0,0 +1,51 @@
+package scp
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRetry(t *testing.T) {
+	fail := errors.New("fail")
+
+	attempts := 0
+	err := Retry{MaxAttempts: 3}.Do(context.Background(), func(context.Context) error {
+		attempts++
+		return fail
+	})
+	if err != fail || attempts != 3 {
+		t.Errorf("got %v after %d attempts, want %v after 3", err, attempts, fail)
+	}
+
+	attempts = 0
+	err = Retry{}.Do(context.Background(), func(context.Context) error {
+		attempts++
+		if attempts < 5 {
+			return fail
+		}
+		return nil
+	})
+	if err != nil || attempts != 5 {
+		t.Errorf("got %v after %d attempts, want success after 5", err, attempts)
+	}
+
+	// The third wait, of 40ms, would end after the 50ms limit
+	attempts = 0
+	r := Retry{InitialInterval: 10 * time.Millisecond, Multiplier: 2, MaxElapsedTime: 50 * time.Millisecond}
+	err = r.Do(context.Background(), func(context.Context) error {
+		attempts++
+		return fail
+	})
+	if err != fail || attempts != 3 {
+		t.Errorf("got %v after %d attempts, want %v after 3", err, attempts, fail)
+	}
+
+	r = Retry{InitialInterval: time.Second, Jitter: 0.5}
+	for i := 0; i < 100; i++ {
+		if d := r.jitter(r.InitialInterval); d < 500*time.Millisecond || d > 1500*time.Millisecond {
+			t.Fatalf("got a wait of %v, want between 0.5s and 1.5s", d)
+		}
+	}
+}
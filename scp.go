@@ -6,171 +6,1101 @@ on top of x/crypto/ssh
 package scp // import "github.com/aedavelli/go-scp"
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"net"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/kballard/go-shellquote"
 	"golang.org/x/crypto/ssh"
 )
 
+// Client copies files over the SSH connection SshClient. Its settings are in the
+// embedded Options, whose fields are set directly on the client, apart from
+// Quiet: c.Quiet is the deprecated field of Client, c.Options.Quiet the setting.
+//
+// A Client may be used by several goroutines at once, each transfer running in
+// its own SSH session with state of its own. SetLogger may be called at any time,
+// but the Options must not be changed while transfers are running; use
+// WithOptions to get a client with other settings instead. A Client must not be
+// copied once used.
 type Client struct {
-	SshClient    *ssh.Client
+	SshClient *ssh.Client
+	// Deprecated: PreseveTimes and Quiet are the settings of former versions,
+	// kept so that Client literals naming them still compile. Each one is an
+	// alias of its field of Options, PreserveTimes and Quiet: the constructors
+	// and the options of Dial set both, and the one changed since then wins,
+	// so that clearing either one turns times off for a client of NewClient.
+	// In a Client literal, setting either one is enough.
 	PreseveTimes bool
 	Quiet        bool
+
+	Options
+
+	// The values both fields of a setting and its alias were last given
+	// together, see alias
+	syncedTimes, syncedQuiet bool
+
+	mu sync.RWMutex // guards logger and sessions
+	// Where messages go, see SetLogger
+	logger Logger
+	// Created on first use, see MaxSessions
+	sessions *sessionSlots
+}
+
+// Options are the settings deciding how a Client behaves. They can be replaced
+// all at once, for a single transfer for instance, with WithOptions.
+//
+// The callbacks are called from the goroutine running the transfer, so with
+// transfers running at the same time they must be safe for concurrent use. The
+// Stats given to OnComplete are those of the one transfer.
+type Options struct {
+	// PreserveTimes sends the modification times along with the files, and
+	// gives the received ones those of the remote side, like scp -p
+	PreserveTimes bool
+	// Quiet runs the remote scp with -q and leaves out the informational
+	// messages
+	Quiet bool
+
+	// PathMapper, when set, is called with the local path of every entry
+	// visited while walking the sources. It returns the path, relative to
+	// the destination directory, under which the entry should be created on
+	// the remote side. Intermediate remote directories are created as needed.
+	// Returning an empty string skips the entry; for a directory the whole
+	// subtree is skipped.
+	PathMapper func(localPath string) (remoteName string)
+
+	// Filter, when set, is called with every entry visited while walking the
+	// local paths, before PathMapper, with its slash separated path relative
+	// to the directory holding the path given to Send, such as src/a.txt for
+	// src. Returning false leaves the entry out, with everything under it for
+	// a directory. The entries of a Source given to SendSource bypass it. See
+	// WithExclude.
+	Filter func(path string, info os.FileInfo) bool
+
+	// OnConflict decides what Receive does when a received file already
+	// exists locally. The default is to overwrite it, like scp.
+	OnConflict ConflictPolicy
+
+	// SendOverwritePolicy decides what Send does with files that already
+	// exist on the remote side. scp itself always overwrites, which is the
+	// default. With Skip or Fail, Send first runs one extra remote command, a
+	// POSIX shell loop calling test -e on every file it is about to create,
+	// with the names fed through its stdin. Rename is not supported.
+	SendOverwritePolicy ConflictPolicy
+
+	// Backup makes Send rename remote files it is about to overwrite to
+	// name+BackupSuffix first, giving a way to roll back a bad deploy. The
+	// existing files are found with the same remote check as for
+	// SendOverwritePolicy and renamed with a second remote command running mv.
+	// For a timestamped backup set BackupSuffix to something like
+	// "." + time.Now().Format("20060102150405").
+	Backup bool
+	// BackupSuffix defaults to ".bak"
+	BackupSuffix string
+
+	// Flatten sends every regular file found under the paths directly into
+	// the destination directory, which must exist, dropping the directory
+	// structure. When two files end up with the same name SendOverwritePolicy
+	// decides: with Overwrite the last one wins, with Skip the first one, and
+	// Fail makes Send return an error before anything is transferred.
+	Flatten bool
+
+	// PreserveSpecialBits includes the setuid, setgid and sticky bits in the
+	// modes sent along with files and directories. The remote side only keeps
+	// them if its scp and filesystem allow it; OpenSSH's sink, for instance,
+	// drops the sticky bit and applies its umask unless run with -p.
+	PreserveSpecialBits bool
+
+	// ContinueOnError makes Send skip local files and directories it can't
+	// read, printing a warning, instead of aborting the transfer
+	ContinueOnError bool
+
+	// OnError, when set, is called when Send fails to read a local file or
+	// directory, or the remote side refuses a file, in place of the
+	// ContinueOnError and AbortOnWarning handling. Returning nil skips the
+	// file and goes on with the transfer, returning an error aborts it.
+	OnError func(path string, err error) error
+
+	// OnStart, when set, is called once Send has looked at what it is about
+	// to send, with the number of regular files and their total size, before
+	// anything is sent. Counting takes an extra walk of the local paths.
+	OnStart func(totalFiles int, totalBytes int64)
+	// OnComplete, when set, is called when Send is done, whether it succeeded
+	// or not
+	OnComplete func(stats Stats, err error)
+
+	// AbortOnWarning makes Send stop at the first warning from the remote
+	// side, such as a file it can't create. By default, like scp, the
+	// transfer goes on with the next file and Send returns an error listing
+	// the warnings once it is done.
+	AbortOnWarning bool
+
+	// WaitTimeout bounds how long Send waits for the remote scp to exit once
+	// everything has been sent, after which the session is closed and an error
+	// returned. Zero means no limit.
+	WaitTimeout time.Duration
+
+	// OnProgress, when set, is called as the body of each file is sent, with
+	// the local path, the number of bytes sent so far and the size of the
+	// file. It is first called with nothing sent when the file starts.
+	OnProgress func(path string, sent, total int64)
+
+	// ChunkSize, when set, makes Send copy the body of each file ChunkSize
+	// bytes at a time, calling OnProgress after every chunk and stopping
+	// between chunks once the context is cancelled. Only the local copy loop
+	// is affected, each file is still sent as a single body.
+	ChunkSize int64
+
+	// BufferSize is the size of the buffers file bodies are copied through,
+	// locally, when sending and receiving. The default is 32 KiB.
+	BufferSize int
+
+	// Context, when set, is the context of the methods which don't take one,
+	// such as Send, SendContents, SendSource, SendTree and Receive: they stop
+	// when it is done, as SendContext does. The methods taking a context, such
+	// as SendContext, use theirs instead.
+	Context context.Context
+
+	// RateLimiter, when set, caps the rate at which Send copies file bodies.
+	// It is called with the size of every chunk before copying it, chunks
+	// being ChunkSize bytes, 32 KiB if not set. Being shared by all the files
+	// of a Send, and by all the Sends of the client, it limits their
+	// aggregate throughput. See NewRateLimiter.
+	RateLimiter RateLimiter
+
+	// OnReceiveProgress, when set, is called as the body of each file is
+	// received, with the local path, the number of bytes received so far and
+	// the size announced by the remote side. Like OnProgress it is first
+	// called with nothing received.
+	OnReceiveProgress func(path string, received, total int64)
+
+	// OnProgressEvent, when set, is called along with OnProgress and
+	// OnReceiveProgress, with more details such as the estimated time left
+	OnProgressEvent func(ev ProgressEvent)
+
+	// KeepPartial makes Receive rename a file it couldn't receive completely,
+	// because the transfer was interrupted or cancelled, to name.partial
+	// instead of removing it
+	KeepPartial bool
+
+	// SkipUnchanged makes Receive leave alone local files which already have
+	// the size and modification time of the remote ones. Times are requested
+	// from the remote side with scp -p and given to the files received. The
+	// remote side streams every file regardless, so this saves disk writes,
+	// not bandwidth.
+	SkipUnchanged bool
+
+	// Debug logs every protocol record written and every response read, with
+	// non printable bytes in hex, which helps with remote scp implementations
+	// behaving unexpectedly. File contents are left out.
+	Debug bool
+
+	// ScpPath is the remote scp program run by Send and Receive, "scp", found
+	// in the remote PATH, if empty
+	ScpPath string
+
+	// ExtraArgs are passed to the remote scp, by Send and Receive, after the
+	// flags set by the client, for options specific to the remote
+	// implementation such as -l to limit the bandwidth. Arguments which change
+	// what scp writes on its stdout, like -v on some implementations, break
+	// the protocol.
+	ExtraArgs []string
+
+	// Recursive decides whether Send runs the remote scp with -r. By default
+	// it is only used when sending directories.
+	Recursive RecursiveMode
+
+	// Manifest, when set, gets a line for every regular file sent by Send,
+	// with its SHA-256 and its path relative to the destination, in the
+	// format of sha256sum, once the transfer succeeded. The hashes are
+	// computed as the files are sent.
+	Manifest io.Writer
+	// ManifestName, when set, makes Send also create the manifest in the
+	// destination directory under that name, as the last file, so that the
+	// files can be checked there with sha256sum -c
+	ManifestName string
+
+	// VerifyManifest, when set, holds the expected SHA-256 of the files to
+	// send, in hex, by path relative to the destination, as returned by
+	// ParseManifest. Send first hashes every regular file it is about to send
+	// and fails before sending anything if one doesn't match, or isn't listed.
+	// With SkipMismatched such files are left out with a warning instead.
+	VerifyManifest map[string]string
+	SkipMismatched bool
+
+	// HashWorkers, when set, makes Send hash that many files at a time for
+	// VerifyManifest, and for Manifest, which then gets the hashes before
+	// anything is sent instead of as the files are sent. Files hashed that way
+	// must not change in between.
+	HashWorkers int
+
+	// Concurrency, when above 1, makes Send spread the paths it is given over
+	// that many sessions running at the same time, every path being sent
+	// whole by one of them. It is capped at 8, and at MaxSessions when set,
+	// each session counting against the server's MaxSessions. With Flatten or
+	// ManifestName the paths are always sent in a single session.
+	Concurrency int
+
+	// ExpandEnv makes Send replace the variables in the destination, as in
+	// $DEPLOY_DIR/app or ${DEPLOY_DIR}, with their values on the remote side,
+	// found with a remote printf. Only the values of plain variable names are
+	// read, the destination itself never goes through the remote shell, so it
+	// can't run commands. A variable which isn't set is an error.
+	ExpandEnv bool
+
+	// MaxSessions, when set, is the number of sessions the client and those
+	// made from it with WithOptions keep open at once on their connection,
+	// further transfers and commands waiting for one to end. Set it to the
+	// MaxSessions of the server, 10 by default with OpenSSH, to share the
+	// connection among many goroutines. Copy3 on a single connection takes
+	// two sessions.
+	MaxSessions int
+	// SessionWait is how long opening a session keeps trying while the server
+	// refuses it for having too many open, "administratively prohibited", 30
+	// seconds if zero. The refusal is returned right away if negative.
+	SessionWait time.Duration
+}
+
+// WithOptions returns a client sharing the connection, and the logger, of c with
+// the settings opts, the deprecated fields of Client being left unset
+func (c *Client) WithOptions(opts Options) *Client {
+	return &Client{SshClient: c.SshClient, Options: opts, logger: c.getLogger(), sessions: c.slots()}
 }
 
-// Form send command based on client configuration
-func (c *Client) getSendCommand(dst string) string {
-	cmd := "scp -rt"
+// The settings of c, with those of its deprecated fields folded in
+func (c *Client) options() Options {
+	opts := c.Options
+	opts.PreserveTimes = c.preserveTimes()
+	opts.Quiet = c.quiet()
+	return opts
+}
 
-	if c.PreseveTimes {
+// Report whether Quiet is set, on c or in its Options
+func (c *Client) quiet() bool {
+	return alias(c.Options.Quiet, c.Quiet, c.syncedQuiet)
+}
+
+func (c *Client) setQuiet(b bool) {
+	c.Options.Quiet, c.Quiet, c.syncedQuiet = b, b, b
+}
+
+// Resolve a setting and its deprecated alias, both given synced last: the one
+// changed since wins, the setting if both were
+func alias(setting, deprecated, synced bool) bool {
+	if setting != synced {
+		return setting
+	}
+	return deprecated
+}
+
+// The remote scp command, quoted for the remote shell
+func (c *Client) scpPath() string {
+	if c.ScpPath == "" {
+		return "scp"
+	}
+	return shellquote.Join(c.ScpPath)
+}
+
+// The context of the methods which don't take one
+func (c *Client) context() context.Context {
+	if c.Context != nil {
+		return c.Context
+	}
+	return context.Background()
+}
+
+// Upper limit of Concurrency
+const maxConcurrency = 8
+
+// Stats summarizes a transfer
+type Stats struct {
+	// Files is the number of regular files transferred
+	Files int
+	// Bytes is the total size of the files transferred
+	Bytes int64
+	// Warnings are the non fatal problems reported by the remote side
+	Warnings []string
+}
+
+// State of a single Send call
+type sendState struct {
+	ctx context.Context
+	// transfer is set for a transfer which can be paused
+	transfer *Transfer
+	w        io.Writer
+	r        *bufio.Reader
+	stats    Stats
+	// Remote paths, relative to dst, which must not be sent
+	skip map[string]bool
+	// Remote paths sent so far, to resolve collisions when flattening
+	sent map[string]bool
+	// Local files sent so far, and the one being sent
+	done    []string
+	current string
+	// Lines of the manifest, nil if there is none to make, and the hashes
+	// already computed, by local path
+	manifest *bytes.Buffer
+	hashes   map[string]string
+}
+
+// PartialError is returned by Send when a transfer fails after it started. It
+// tells which files made it to the remote side, in the order they were sent.
+type PartialError struct {
+	// Sent are the local paths of the files sent
+	Sent []string
+	// Failed is the local path of the file being sent at the time of the
+	// failure, if any
+	Failed string
+	Err    error
+}
+
+func (e *PartialError) Error() string {
+	if e.Failed != "" {
+		return fmt.Sprintf("%v (sending %s, %d files sent)", e.Err, e.Failed, len(e.Sent))
+	}
+	return fmt.Sprintf("%v (%d files sent)", e.Err, len(e.Sent))
+}
+
+func (e *PartialError) Unwrap() error {
+	return e.Err
+}
+
+// Wrap the error ending the transfer in a *PartialError
+func (s *sendState) partialError(err error) error {
+	return &PartialError{Sent: s.done, Failed: s.current, Err: err}
+}
+
+// RecursiveMode decides whether Send runs the remote scp with -r
+type RecursiveMode int
+
+const (
+	// RecursiveAuto uses -r only when directories may be sent
+	RecursiveAuto RecursiveMode = iota
+	// RecursiveAlways always uses -r
+	RecursiveAlways
+	// RecursiveNever never uses -r, sending a directory then fails
+	RecursiveNever
+)
+
+// SendCommand returns the command Send(dst, paths...) runs on the remote side to
+// receive the files, which depends on the client configuration and on the paths.
+// With RecursiveAuto, Send leaves out the -r flag when only regular files are
+// sent without a PathMapper, and adds -d, making the remote side check that dst
+// is a directory, when several entries may be sent. dst is shown as given, Send
+// first expands a leading ~ and, with ExpandEnv, variables.
+func (c *Client) SendCommand(dst string, paths ...string) (string, error) {
+	if dst == "" {
+		return "", errors.New("Missing remote destination")
+	}
+	if len(paths) == 0 {
+		return "", errors.New("No files to send")
+	}
+	_, recursive, dirTarget := c.localSources(paths, false)
+	return c.sendCommand(dst, recursive, dirTarget), nil
+}
+
+func (c *Client) sendCommand(dst string, recursive, dirTarget bool) string {
+	cmd := c.scpPath() + " -t"
+	if recursive {
+		cmd = c.scpPath() + " -rt"
+	}
+
+	if dirTarget {
+		cmd += "d"
+	}
+
+	if c.preserveTimes() {
 		cmd += "p"
 	}
 
-	if c.Quiet {
+	if c.quiet() {
 		cmd += "q"
 	}
 
-	return fmt.Sprintf("%s %s", cmd, shellquote.Join(dst))
+	if len(c.ExtraArgs) > 0 {
+		cmd += " " + shellquote.Join(c.ExtraArgs...)
+	}
+
+	return fmt.Sprintf("%s %s", cmd, quotePath(dst))
 }
 
 // Send the files dst directory on remote side. The paths can be regular files or directories.
+// Like with rsync, a directory path ending with a separator, such as dir/, sends
+// the content of the directory rather than the directory itself. A leading ~ in dst
+// stands for the remote home directory.
 func (c *Client) Send(dst string, paths ...string) error {
-	// Create an SSH session
-	session, err := c.SshClient.NewSession()
+	_, err := c.send(c.context(), dst, false, paths, nil)
+	return err
+}
+
+// SendContext is like Send but aborts the transfer, closing the session, when ctx
+// is done. It then returns a *PartialError wrapping ctx.Err(). ctx replaces the
+// Context of the options, which isn't looked at.
+func (c *Client) SendContext(ctx context.Context, dst string, paths ...string) error {
+	_, err := c.send(ctx, dst, false, paths, nil)
+	return err
+}
+
+// SendWithStats is like Send and also returns statistics about the transfer, which
+// are meaningful even if it failed.
+func (c *Client) SendWithStats(dst string, paths ...string) (Stats, error) {
+	return c.send(c.context(), dst, false, paths, nil)
+}
+
+// SendAll sends each of the paths to dst in a session of its own, going on after
+// failures, and returns the error of every path, nil on success
+func (c *Client) SendAll(dst string, paths ...string) map[string]error {
+	errs := make(map[string]error, len(paths))
+	for _, p := range paths {
+		errs[p] = c.Send(dst, p)
+	}
+	return errs
+}
+
+// SendContents sends the children of the local srcDir directly into the remote dst
+// directory, without creating srcDir itself. It is the equivalent of
+// scp -r srcDir/* remote:dst, hidden files included.
+func (c *Client) SendContents(dst, srcDir string) error {
+	fi, err := os.Stat(srcDir)
 	if err != nil {
-		return errors.New("Failed to create SSH session: " + err.Error())
+		return err
+	}
+	if !fi.IsDir() {
+		return errors.New("Not a directory: " + srcDir)
+	}
+	_, err = c.send(c.context(), dst, true, []string{srcDir}, nil)
+	return err
+}
+
+// Send the paths, or their contents if contents is set, to dst
+func (c *Client) send(ctx context.Context, dst string, contents bool, paths []string, t *Transfer) (Stats, error) {
+	sources, recursive, dirTarget := c.localSources(paths, contents)
+	return c.sendSources(ctx, dst, sources, recursive, dirTarget, t)
+}
+
+// The sources sending the paths, or their contents if contents is set, and
+// whether scp needs -r and -d for them
+func (c *Client) localSources(paths []string, contents bool) (sources []Source, recursive, dirTarget bool) {
+	sources = make([]Source, len(paths))
+	anyContents := contents
+	for i, p := range paths {
+		// filepath.Clean drops the trailing separator, which means the
+		// content of the directory
+		pc := contents || strings.HasSuffix(p, "/") || strings.HasSuffix(p, string(os.PathSeparator))
+		anyContents = anyContents || pc
+		sources[i] = &localSource{c: c, path: p, contents: pc}
+	}
+	// Flatten and PathMapper may turn a single path into several entries, dst
+	// must be a directory for them
+	dirTarget = len(paths) > 1 || anyContents || c.Flatten || c.PathMapper != nil
+	return sources, c.recursive(paths, anyContents), dirTarget
+}
+
+// Send the entries of the sources to dst, running scp with -r if recursive and
+// with -d if dirTarget
+func (c *Client) sendSources(ctx context.Context, dst string, sources []Source, recursive, dirTarget bool, t *Transfer) (stats Stats, err error) {
+	defer func() {
+		if err != nil {
+			c.logEvent(LogEvent{Event: EventError, Err: err})
+		}
+		if c.OnComplete != nil {
+			c.OnComplete(stats, err)
+		}
+	}()
+
+	// scp would only fail later on with a confusing message
+	if dst == "" {
+		return Stats{}, errors.New("Missing remote destination")
+	}
+	if len(sources) == 0 {
+		return Stats{}, errors.New("No files to send")
+	}
+	if dst, err = c.expandRemotePath(dst); err != nil {
+		return Stats{}, err
+	}
+
+	if p := c.SendOverwritePolicy; p != Overwrite && p != Skip && p != Fail {
+		return Stats{}, errors.New("Unsupported send overwrite policy")
+	}
+
+	if c.Flatten && c.SendOverwritePolicy == Fail {
+		if err := c.checkFlattenCollisions(sources); err != nil {
+			return Stats{}, err
+		}
+	}
+
+	var skip map[string]bool
+	if c.SendOverwritePolicy != Overwrite || c.Backup {
+		existing, err := c.existingRemoteFiles(dst, sources)
+		if err != nil {
+			return Stats{}, err
+		}
+
+		switch c.SendOverwritePolicy {
+		case Overwrite:
+			if err := c.backupRemoteFiles(dst, existing); err != nil {
+				return Stats{}, err
+			}
+		case Skip:
+			skip = existing
+		case Fail:
+			if len(existing) > 0 {
+				names := make([]string, 0, len(existing))
+				for name := range existing {
+					names = append(names, name)
+				}
+				sort.Strings(names)
+				return Stats{}, errors.New("Remote files already exist: " + strings.Join(names, ", "))
+			}
+		}
+	}
+
+	var hashes []fileHash
+	if c.VerifyManifest != nil || (c.HashWorkers > 0 && (c.Manifest != nil || c.ManifestName != "")) {
+		if hashes, err = c.hashFiles(sources, skip); err != nil {
+			return Stats{}, err
+		}
+	}
+
+	if c.VerifyManifest != nil {
+		mismatched, err := c.verifyManifest(hashes)
+		if err != nil {
+			return Stats{}, err
+		}
+		if len(mismatched) > 0 && skip == nil {
+			skip = make(map[string]bool)
+		}
+		for name := range mismatched {
+			skip[name] = true
+		}
 	}
-	defer session.Close()
 
-	// Setup Input strem
-	w, err := session.StdinPipe()
+	if c.OnStart != nil {
+		files, bytes := c.countFiles(sources, skip)
+		c.OnStart(files, bytes)
+	}
+
+	var states []*sendState
+	if workers := c.sendWorkers(len(sources)); workers > 1 {
+		states, err = c.sendParallel(ctx, workers, dst, sources, recursive, dirTarget, t, skip, hashes)
+	} else {
+		var s *sendState
+		s, err = c.sendSession(ctx, dst, sources, recursive, dirTarget, t, skip, hashes, c.ManifestName != "")
+		states = []*sendState{s}
+	}
+
+	// Put together what the sessions did
+	s := &sendState{}
+	for _, ws := range states {
+		if ws == nil {
+			continue
+		}
+		s.stats.Files += ws.stats.Files
+		s.stats.Bytes += ws.stats.Bytes
+		s.stats.Warnings = append(s.stats.Warnings, ws.stats.Warnings...)
+		s.done = append(s.done, ws.done...)
+		if ws.manifest != nil {
+			if s.manifest == nil {
+				s.manifest = new(bytes.Buffer)
+			}
+			s.manifest.Write(ws.manifest.Bytes())
+		}
+	}
+	if states[0] != nil {
+		s.current = states[0].current
+	}
 	if err != nil {
-		return errors.New("Unable to get stdin: " + err.Error())
+		if states[0] == nil && len(states) == 1 {
+			// Nothing started
+			return Stats{}, err
+		}
+		return s.stats, s.partialError(err)
+	}
+	if len(s.stats.Warnings) > 0 {
+		return s.stats, s.partialError(errors.New("Remote reported warnings: " + strings.Join(s.stats.Warnings, "; ")))
 	}
-	defer w.Close()
+	if c.Manifest != nil {
+		if _, err := c.Manifest.Write(s.manifest.Bytes()); err != nil {
+			return s.stats, errors.New("Failed to write the manifest: " + err.Error())
+		}
+	}
+	return s.stats, nil
+}
 
-	// Setup Output strem
-	r, err := session.StdoutPipe()
+// The number of sessions to spread n sources over
+func (c *Client) sendWorkers(n int) int {
+	// The order of the paths decides what happens when flattened names
+	// collide, and the manifest file closes the only session
+	if c.Flatten || c.ManifestName != "" {
+		return 1
+	}
+	workers := c.Concurrency
+	if workers > maxConcurrency {
+		workers = maxConcurrency
+	}
+	if c.MaxSessions > 0 && workers > c.MaxSessions {
+		workers = c.MaxSessions
+	}
+	if workers > n {
+		workers = n
+	}
+	return workers
+}
+
+// Send the sources spread over workers sessions, stopping them all at the first
+// error. The states of the sessions are returned, nil for those that didn't
+// start, the one that failed first coming first.
+func (c *Client) sendParallel(ctx context.Context, workers int, dst string, sources []Source, recursive, dirTarget bool, t *Transfer, skip map[string]bool, hashes []fileHash) ([]*sendState, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	shares := make([][]Source, workers)
+	for i, src := range sources {
+		shares[i%workers] = append(shares[i%workers], src)
+	}
+
+	states := make([]*sendState, workers)
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+		failed   int
+	)
+	for i := range shares {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s, err := c.sendSession(ctx, dst, shares[i], recursive, dirTarget, t, skip, hashes, false)
+			states[i] = s
+			if err != nil {
+				mu.Lock()
+				// The others fail with the cancellation which follows
+				if firstErr == nil {
+					firstErr, failed = err, i
+					cancel()
+				}
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	states[0], states[failed] = states[failed], states[0]
+	return states, firstErr
+}
+
+// Send the entries of the sources to dst in a session of their own, followed by
+// the manifest with manifestName. The state is nil if the session didn't start.
+func (c *Client) sendSession(ctx context.Context, dst string, sources []Source, recursive, dirTarget bool, t *Transfer, skip map[string]bool, hashes []fileHash, manifestName bool) (*sendState, error) {
+	ss, err := c.startSession(ctx, c.sendCommand(dst, recursive, dirTarget))
 	if err != nil {
-		return errors.New("Unable to get Stdout: " + err.Error())
+		return nil, err
 	}
+	defer ss.session.Close()
+	defer closeOnCancel(ctx, ss)()
 
-	fmt.Println(c.getSendCommand(dst))
-	if err := session.Start(c.getSendCommand(dst)); err != nil {
-		return errors.New("Failed to start: " + err.Error())
+	s := &sendState{
+		ctx:      ctx,
+		transfer: t,
+		w:        ss.stdin,
+		r:        ss.stdout,
+		skip:     skip,
+		sent:     make(map[string]bool),
+	}
+	if c.Manifest != nil || c.ManifestName != "" {
+		s.manifest = new(bytes.Buffer)
+		s.hashes = make(map[string]string, len(hashes))
+		for _, h := range hashes {
+			s.hashes[h.path] = h.sum
+		}
 	}
 
-	errors := make(chan error)
+	_, err = c.readAck(s)
+	for _, src := range sources {
+		if err != nil {
+			break
+		}
+		err = c.walkAndSend(s, src)
+	}
+	if err == nil && manifestName {
+		err = c.sendManifest(s)
+	}
 
-	go func() {
-		errors <- session.Wait()
+	if err != nil {
+		if ctx.Err() != nil {
+			return s, ctx.Err()
+		}
+		// If the remote side gave up first, its stderr tells why
+		ss.stdin.Close()
+		c.wait(ctx, ss)
+		if msg := strings.TrimSpace(ss.stderr.String()); msg != "" {
+			err = fmt.Errorf("%w (remote: %s)", err, msg)
+		}
+		return s, err
+	}
+
+	err = c.finish(ctx, ss)
+	if ctx.Err() != nil {
+		return s, ctx.Err()
+	}
+	if len(s.stats.Warnings) > 0 {
+		// scp exits unsuccessfully after a warning, the warnings say more
+		// and are reported once all the sessions are done
+		return s, nil
+	}
+	return s, err
+}
+
+// send regular file
+func (c *Client) sendRegularFile(s *sendState, src Source, path, remotePath string, fi os.FileInfo) (err error) {
+	// Open before writing anything, a file that can't be read must not
+	// leave a dangling header in the stream
+	f, err := src.Open(path)
+	if err != nil {
+		return c.skipOnError(path, fmt.Errorf("Failed to open local file: %w", err))
+	}
+	defer f.Close()
+
+	// A file the remote refused is not the one a later failure is about
+	s.current = path
+	defer func() {
+		if err == nil {
+			s.current = ""
+		}
 	}()
 
-	for _, p := range paths {
-		if err := c.walkAndSend(w, p); err != nil {
-			return err
+	// A warning in response to a header means the remote won't take the file
+	if c.preserveTimes() {
+		if ok, err := c.writeRecord(s, fmt.Sprintf("T%d 0 %d 0\n", fi.ModTime().Unix(), time.Now().Unix())); !ok {
+			return c.refused(s, path, err)
 		}
 	}
-	w.Close()
-	io.Copy(os.Stdout, r)
-	<-errors
+	name := remotePath[strings.LastIndex(remotePath, "/")+1:]
+	if ok, err := c.writeRecord(s, fmt.Sprintf("C%s %d %s\n", c.formatMode(fi.Mode()), fi.Size(), name)); !ok {
+		return c.refused(s, path, err)
+	}
+	start := time.Now()
+	c.logEvent(LogEvent{Event: EventFileStart, Path: path})
+	// Send exactly the announced size, the remote side counts the bytes to
+	// find the end of the body. A file which shrank since it was stat'ed
+	// leaves the stream out of step, so the whole transfer has to stop.
+	var r io.Reader = f
+	var h hash.Hash
+	sum, hashed := s.hashes[path]
+	if s.manifest != nil && !hashed {
+		h = sha256.New()
+		r = io.TeeReader(f, h)
+	}
+	buf := getCopyBuffer(c.BufferSize)
+	defer putCopyBuffer(buf)
+	if n, err := c.copyBody(s, r, path, fi.Size(), *buf); err == io.EOF {
+		return fmt.Errorf("Local file %s shrank during the transfer: %d bytes sent out of %d", path, n, fi.Size())
+	} else if err != nil {
+		return errors.New("Copy failed: " + err.Error())
+	}
+	if ok, err := c.writeRecord(s, "\x00"); !ok {
+		return err
+	}
 
+	s.stats.Files++
+	s.stats.Bytes += fi.Size()
+	s.done = append(s.done, path)
+	if s.manifest != nil {
+		if !hashed {
+			sum = hex.EncodeToString(h.Sum(nil))
+		}
+		fmt.Fprintf(s.manifest, "%s  %s\n", sum, remotePath)
+	}
+	c.logEvent(LogEvent{Event: EventFileCopied, Path: path, Bytes: fi.Size(), Duration: time.Since(start)})
+	c.infof("Copied: %s", path)
 	return nil
 }
 
-// send regular file
-func (c *Client) sendRegularFile(w io.Writer, path string, fi os.FileInfo) error {
-	if c.PreseveTimes {
-		_, err := fmt.Fprintf(w, "T%d 0 %d 0\n", fi.ModTime().Unix(), time.Now().Unix())
+// Handle the failure to send the header of the file at path. Without an error the
+// remote side refused the file with a warning, which OnError gets to decide about.
+func (c *Client) refused(s *sendState, path string, err error) error {
+	if err != nil || c.OnError == nil {
+		return err
+	}
+	return c.OnError(path, &ackError{msg: s.stats.Warnings[len(s.stats.Warnings)-1]})
+}
+
+// Copy size bytes of the body of the file at path from r to the remote side
+// through buf, reporting the progress
+func (c *Client) copyBody(s *sendState, r io.Reader, path string, size int64, buf []byte) (int64, error) {
+	report := c.progress(false)
+	if report != nil {
+		report(path, 0, size)
+	}
+
+	chunkSize := c.ChunkSize
+	if chunkSize <= 0 && s.transfer != nil {
+		chunkSize = pauseChunkSize
+	}
+	if chunkSize <= 0 && c.RateLimiter != nil {
+		chunkSize = rateChunkSize
+	}
+
+	if chunkSize <= 0 {
+		var w io.Writer = s.w
+		if report != nil {
+			w = &ProgressWriter{W: s.w, Path: path, Total: size, OnProgress: report}
+		}
+		return copyN(w, r, size, buf)
+	}
+
+	var sent int64
+	for sent < size {
+		if err := s.ctx.Err(); err != nil {
+			return sent, err
+		}
+		if s.transfer != nil {
+			if err := s.transfer.wait(s.ctx); err != nil {
+				return sent, err
+			}
+		}
+
+		n := chunkSize
+		if left := size - sent; left < n {
+			n = left
+		}
+		if c.RateLimiter != nil {
+			if err := c.RateLimiter.WaitN(s.ctx, int(n)); err != nil {
+				return sent, err
+			}
+		}
+		m, err := copyN(s.w, r, n, buf)
+		sent += m
 		if err != nil {
-			return err
+			return sent, err
+		}
+		if report != nil {
+			report(path, sent, size)
 		}
 	}
-	_, err := fmt.Fprintf(w, "C%#o %d %s\n", fi.Mode().Perm(), fi.Size(), fi.Name())
-	if err != nil {
-		return errors.New("Copy failed: " + err.Error())
+	return sent, nil
+}
+
+// Write a protocol record and wait for the remote side to acknowledge it. ok is
+// false if it didn't, either because of an error or because of a warning which
+// doesn't abort the transfer.
+func (c *Client) writeRecord(s *sendState, record string) (ok bool, err error) {
+	if err := c.sendRecord(s.w, record); err != nil {
+		return false, errors.New("Copy failed: " + err.Error())
 	}
-	f, err := os.Open(path)
-	if err != nil {
-		return err
+	return c.readAck(s)
+}
+
+// Read an acknowledgement from the remote side. Warnings are collected in the stats
+// and only returned as errors with AbortOnWarning.
+func (c *Client) readAck(s *sendState) (ok bool, err error) {
+	err = c.recvAck(s.r)
+
+	var ae *ackError
+	if errors.As(err, &ae) && !ae.fatal {
+		s.stats.Warnings = append(s.stats.Warnings, ae.msg)
+		if !c.AbortOnWarning || c.OnError != nil {
+			return false, nil
+		}
 	}
-	defer f.Close()
-	io.Copy(w, f)
-	fmt.Fprint(w, "\x00")
-	if !c.Quiet {
-		fmt.Println("Copied: ", path)
+	return err == nil, err
+}
+
+// Swallow the err about the local path with a warning when ContinueOnError is set,
+// or leave it to OnError
+func (c *Client) skipOnError(path string, err error) error {
+	if c.OnError != nil {
+		return c.OnError(path, err)
 	}
+	if !c.ContinueOnError {
+		return err
+	}
+	c.warnf("Skipped: %v", err)
 	return nil
 }
 
-// Walk and Send directory
-func (c *Client) walkAndSend(w io.Writer, src string) error {
+// Format a file mode as the four octal digits of C and D records
+func (c *Client) formatMode(m os.FileMode) string {
+	return string(c.appendMode(make([]byte, 0, 4), m))
+}
+
+// Append the four octal digits of a file mode to b
+func (c *Client) appendMode(b []byte, m os.FileMode) []byte {
+	if !c.PreserveSpecialBits {
+		m = m.Perm()
+	}
+	mode := unixPerm(m)
+	for shift := 9; shift >= 0; shift -= 3 {
+		b = append(b, byte('0'+mode>>uint(shift)&7))
+	}
+	return b
+}
+
+// Convert the permission and setuid, setgid and sticky bits of a file mode to
+// their unix values
+func unixPerm(m os.FileMode) uint32 {
+	mode := uint32(m.Perm())
+	if m&os.ModeSetuid != 0 {
+		mode |= 04000
+	}
+	if m&os.ModeSetgid != 0 {
+		mode |= 02000
+	}
+	if m&os.ModeSticky != 0 {
+		mode |= 01000
+	}
+	return mode
+}
+
+// Walk src, calling fn for every regular file and directory with the slash
+// separated path it gets on the remote side, relative to the destination. With contents set, src
+// itself is left out and its children are placed directly in the destination.
+func (c *Client) walk(src string, contents bool, fn func(path, remotePath string, info os.FileInfo) error) error {
 	cleanedPath := filepath.Clean(src)
 
 	fi, err := os.Stat(cleanedPath)
 	if err != nil {
-		return err
+		return c.skipOnError(cleanedPath, fmt.Errorf("Failed to stat local file: %w", err))
+	}
+	if contents && !fi.IsDir() {
+		return c.skipOnError(cleanedPath, errors.New("Not a directory: "+src))
+	}
+
+	// Remote names are relative to the parent of src, so that src itself
+	// is created inside the destination directory
+	base := filepath.Dir(cleanedPath)
+	if contents {
+		base = cleanedPath
 	}
 
-	if fi.Mode().IsRegular() {
-		if err = c.sendRegularFile(w, cleanedPath, fi); err != nil {
+	return filepath.Walk(cleanedPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if err = c.skipOnError(path, fmt.Errorf("Failed to read local directory: %w", err)); err == nil && info != nil && info.IsDir() {
+				return filepath.SkipDir
+			}
 			return err
 		}
-	}
 
-	// It is a directory need to walk and copy
-	dirStack := strings.Split(cleanedPath, fmt.Sprintf("%c", os.PathSeparator))
-	startStackLen := len(dirStack)
-	dirStack = dirStack[:startStackLen-1]
-	startStackLen--
+		if !info.Mode().IsRegular() && !info.IsDir() {
+			return nil
+		}
+
+		if contents && path == cleanedPath {
+			return nil
+		}
+
+		if c.Filter != nil {
+			if rel, err := filepath.Rel(base, path); err == nil && !c.Filter(filepath.ToSlash(rel), info) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		}
 
-	err = filepath.Walk(cleanedPath, func(path string, info os.FileInfo, err error) error {
+		remotePath, err := c.remotePath(base, path)
 		if err != nil {
 			return err
 		}
+		if remotePath == "" {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
 
-		tmpDirStack := strings.Split(path, fmt.Sprintf("%c", os.PathSeparator))
-		i, di, ci := 0, 0, 0
-		dl, cl := len(dirStack), len(tmpDirStack)
+		if c.Flatten {
+			if info.IsDir() {
+				return nil
+			}
+			remotePath = remotePath[strings.LastIndex(remotePath, "/")+1:]
+		}
 
+		return fn(path, remotePath, info)
+	})
+}
+
+// Walk and Send directory
+func (c *Client) walkAndSend(s *sendState, src Source) error {
+	// The remote directory the stream is in, relative to the destination
+	var dir string
+
+	err := src.Walk(func(path, remotePath string, info os.FileInfo) (err error) {
 		if info.Mode().IsRegular() {
-			tmpDirStack = tmpDirStack[:cl-1]
-			cl--
+			if s.skip[remotePath] || (c.Flatten && c.SendOverwritePolicy == Skip && s.sent[remotePath]) {
+				c.infof("Skipped: %s", path)
+				return nil
+			}
+			s.sent[remotePath] = true
 		}
 
-		for i = 0; i < dl && i < cl; i++ {
-			if dirStack[i] != tmpDirStack[i] {
-				break
-			}
-			di++
-			ci++
+		// The directory the entry goes in, or the directory itself
+		parent := remotePath
+		if info.Mode().IsRegular() {
+			parent = remoteDir(remotePath)
 		}
 
-		for di < dl { // We need to pop
-			fmt.Fprintf(w, "E\n")
-			di++
+		for dir != "" && !inRemoteDir(parent, dir) { // We need to pop
+			if _, err := c.writeRecord(s, "E\n"); err != nil {
+				return err
+			}
+			c.logEvent(LogEvent{Event: EventDirExit, Path: dir})
+			dir = remoteDir(dir)
 		}
 
-		for ci < cl { // We need to push
-			if c.PreseveTimes {
-				_, err := fmt.Fprintf(w, "T%d 0 %d 0\n", info.ModTime().Unix(), time.Now().Unix())
-				if err != nil {
-					return err
+		for len(dir) < len(parent) { // We need to push
+			start := len(dir)
+			if start > 0 {
+				start++
+			}
+			end := len(parent)
+			if i := strings.IndexByte(parent[start:], '/'); i >= 0 {
+				end = start + i
+			}
+
+			// Intermediate directories introduced by the mapper have no
+			// local counterpart, give them a sane default mode
+			mode := os.FileMode(0755)
+			if info.IsDir() && end == len(parent) {
+				mode = info.Mode()
+			}
+
+			// A warning means the remote couldn't create the directory,
+			// leave out whatever goes in it
+			ok := true
+			if c.preserveTimes() {
+				ok, err = c.writeRecord(s, fmt.Sprintf("T%d 0 %d 0\n", info.ModTime().Unix(), time.Now().Unix()))
+			}
+			if ok {
+				ok, err = c.writeRecord(s, fmt.Sprintf("D%s 0 %s\n", c.formatMode(mode), parent[start:end]))
+			}
+			if err != nil {
+				return err
+			}
+			if !ok {
+				if info.IsDir() {
+					return filepath.SkipDir
 				}
+				return nil
 			}
-			fmt.Fprintf(w, "D%#o 0 %s\n", info.Mode().Perm(), tmpDirStack[ci])
-			ci++
+			dir = parent[:end]
+			c.logEvent(LogEvent{Event: EventDirEnter, Path: dir})
 		}
 
-		dirStack = tmpDirStack
 		if info.Mode().IsRegular() {
-			if err = c.sendRegularFile(w, path, info); err != nil {
+			if err := c.sendRegularFile(s, src, path, remotePath, info); err != nil {
 				return err
 			}
 		}
@@ -180,40 +1110,184 @@ func (c *Client) walkAndSend(w io.Writer, src string) error {
 		return err
 	}
 
-	dl := len(dirStack) - 1
+	for ; dir != ""; dir = remoteDir(dir) {
+		if _, err := c.writeRecord(s, "E\n"); err != nil {
+			return err
+		}
+		c.logEvent(LogEvent{Event: EventDirExit, Path: dir})
+	}
+	return nil
+}
+
+// The parent of a slash separated remote path, "" at the top of the destination
+func remoteDir(p string) string {
+	if i := strings.LastIndexByte(p, '/'); i >= 0 {
+		return p[:i]
+	}
+	return ""
+}
+
+// Report whether the remote path p is dir or lies under it
+func inRemoteDir(p, dir string) bool {
+	return strings.HasPrefix(p, dir) && (len(p) == len(dir) || p[len(dir)] == '/')
+}
+
+// Report whether to run scp with -r, which it needs to accept directories, for
+// sending the paths
+func (c *Client) recursive(paths []string, contents bool) bool {
+	switch c.Recursive {
+	case RecursiveAlways:
+		return true
+	case RecursiveNever:
+		return false
+	}
+
+	if contents || c.PathMapper != nil {
+		return true
+	}
+	if c.Flatten {
+		return false
+	}
+	for _, p := range paths {
+		// A path which can't be stat'ed fails later on anyway
+		if fi, err := os.Stat(p); err != nil || fi.IsDir() {
+			return true
+		}
+	}
+	return false
+}
 
-	for dl >= startStackLen {
-		fmt.Fprintf(w, "E\n")
-		dl--
+// Count the regular files of the sources which are to be sent, and their total size
+func (c *Client) countFiles(sources []Source, skip map[string]bool) (files int, bytes int64) {
+	for _, src := range sources {
+		c.quietSource(src).Walk(func(path, remotePath string, info os.FileInfo) error {
+			if info.Mode().IsRegular() && !skip[remotePath] {
+				files++
+				bytes += info.Size()
+			}
+			return nil
+		})
+	}
+	return files, bytes
+}
+
+// Return a Source walking like src but silently skipping what can't be read, for
+// walks which leave errors to the transfer itself
+func (c *Client) quietSource(src Source) Source {
+	ls, ok := src.(*localSource)
+	if !ok {
+		return src
+	}
+	quiet := c.WithOptions(c.options())
+	quiet.OnError = func(string, error) error { return nil }
+	return &localSource{c: quiet, path: ls.path, contents: ls.contents}
+}
+
+// Make sure no two files get the same name when flattening
+func (c *Client) checkFlattenCollisions(sources []Source) error {
+	seen := make(map[string]string)
+	for _, src := range sources {
+		err := src.Walk(func(path, remotePath string, info os.FileInfo) error {
+			if prev, ok := seen[remotePath]; ok {
+				return errors.New("Name collision when flattening: " + prev + " and " + path)
+			}
+			seen[remotePath] = path
+			return nil
+		})
+		if err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
+// Compute the remote path of a local entry, relative to the destination. This is
+// where local separators become the slashes of the protocol, so that a tree gets
+// the same remote layout whatever the local system.
+func (c *Client) remotePath(base, path string) (string, error) {
+	if c.PathMapper == nil {
+		rel, err := filepath.Rel(base, path)
+		return filepath.ToSlash(rel), err
+	}
+
+	remotePath := c.PathMapper(path)
+	if remotePath == "" {
+		return "", nil
+	}
+	remotePath = filepath.Clean(remotePath)
+	slashed := filepath.ToSlash(remotePath)
+	if filepath.IsAbs(remotePath) || strings.HasPrefix(slashed, "/") || slashed == "." || slashed == ".." ||
+		strings.HasPrefix(slashed, "../") {
+		return "", errors.New("Invalid remote path for " + path + ": " + remotePath)
+	}
+	return slashed, nil
+}
+
 // Creates a new SCP client. Use this only with trusted servers, as the host key verification
-// is bypassed. It enables preserve time stamps
+// is bypassed. It enables preserve time stamps. The server port defaults to 22
 func NewDumbClient(username, password, server string) (*Client, error) {
-	client, err := ssh.Dial("tcp", server, &ssh.ClientConfig{
+	return NewDumbClientContext(context.Background(), username, password, server)
+}
+
+// NewDumbClientContext is like NewDumbClient, giving up on connecting when ctx is done
+func NewDumbClientContext(ctx context.Context, username, password, server string) (*Client, error) {
+	c, err := DialContext(ctx, server, WithClientConfig(&ssh.ClientConfig{
 		User: username,
 		Auth: []ssh.AuthMethod{
 			ssh.Password(password),
 		},
 		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-	})
-
+	}))
 	if err != nil {
 		return nil, err
 	}
 
-	return &Client{
-		SshClient:    client,
-		PreseveTimes: true,
-	}, nil
+	c.setPreserveTimes(true)
+	return c, nil
+}
+
+// Report whether to send the modification times, set by PreserveTimes or its
+// deprecated spelling
+func (c *Client) preserveTimes() bool {
+	return alias(c.PreserveTimes, c.PreseveTimes, c.syncedTimes)
+}
+
+func (c *Client) setPreserveTimes(b bool) {
+	c.PreserveTimes, c.PreseveTimes, c.syncedTimes = b, b, b
 }
 
 // Creates a new SCP client form ssh.Client and preserve time stamps
 func NewClient(c *ssh.Client, pt bool) *Client {
-	return &Client{
-		SshClient:    c,
-		PreseveTimes: pt,
+	client := &Client{SshClient: c}
+	client.setPreserveTimes(pt)
+	return client
+}
+
+// Creates a new SCP client over an established connection, such as one going
+// through a proxy, running the SSH handshake with config. addr is the address of
+// the server, passed to the host key callback. The connection is closed if the
+// handshake fails.
+func NewClientFromConn(conn net.Conn, addr string, config *ssh.ClientConfig, preserveTimes bool) (*Client, error) {
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(ssh.NewClient(c, chans, reqs), preserveTimes), nil
+}
+
+// Ping checks that the connection is still alive by sending an SSH keepalive
+// request, which is cheaper than opening a session
+func (c *Client) Ping() error {
+	if _, _, err := c.SshClient.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+		return errors.New("Connection lost: " + err.Error())
 	}
+	return nil
+}
+
+// NewSession opens a session on the underlying connection, to run custom remote
+// commands alongside the transfers. While the server refuses it for having too
+// many sessions open, NewSession tries again, for at most SessionWait. Sessions
+// opened with it don't count against MaxSessions.
+func (c *Client) NewSession() (*ssh.Session, error) {
+	return c.newSession(c.context())
 }
@@ -0,0 +1,901 @@
+package scp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Send state writing to w, reading the remote side's responses from acks. By
+// default every record is acknowledged.
+func newTestSendState(w io.Writer, acks string) *sendState {
+	if acks == "" {
+		acks = strings.Repeat("\x00", 100)
+	}
+	return &sendState{
+		ctx:  context.Background(),
+		w:    w,
+		r:    bufio.NewReader(strings.NewReader(acks)),
+		sent: make(map[string]bool),
+	}
+}
+
+func TestPreserveSpecialBits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "suid")
+	if err := ioutil.WriteFile(path, []byte("x"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(path, 0755|os.ModeSetuid); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		preserve bool
+		header   string
+	}{
+		{false, "C0755 1 suid\n"},
+		{true, "C4755 1 suid\n"},
+	} {
+		var buf bytes.Buffer
+		c := &Client{Options: Options{Quiet: true, PreserveSpecialBits: tc.preserve}}
+		if err := c.walkAndSend(newTestSendState(&buf, ""), &localSource{c: c, path: path}); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(buf.String(), tc.header) {
+			t.Errorf("PreserveSpecialBits=%v: got %q, want header %q", tc.preserve, buf.String(), tc.header)
+		}
+	}
+}
+
+func TestUnreadableFile(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("permissions are not enforced for root")
+	}
+
+	dir, err := ioutil.TempDir("", "scp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "secret")
+	if err := ioutil.WriteFile(path, []byte("x"), 0000); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	c := &Client{Options: Options{Quiet: true}}
+	err = c.walkAndSend(newTestSendState(&buf, ""), &localSource{c: c, path: path})
+	if err == nil || !strings.Contains(err.Error(), "local file") || !os.IsPermission(errors.Unwrap(err)) {
+		t.Errorf("got error %v, want a local permission error", err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("got %q written to the stream, want nothing", buf.String())
+	}
+
+	c.ContinueOnError = true
+	if err := c.walkAndSend(newTestSendState(&buf, ""), &localSource{c: c, path: path}); err != nil {
+		t.Errorf("ContinueOnError: got error %v", err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("ContinueOnError: got %q written to the stream, want nothing", buf.String())
+	}
+}
+
+func TestAcks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.Mkdir(filepath.Join(dir, "d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, "d", name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		name   string
+		acks   string
+		abort  bool
+		stream string
+		files  int
+		warns  []string
+		err    string
+	}{
+		{
+			name:   "ok",
+			acks:   "\x00\x00\x00\x00\x00\x00\x00",
+			stream: "D0755 0 d\nC0644 1 a\na\x00C0644 1 b\nb\x00E\n",
+			files:  2,
+		},
+		{
+			// The body of a file refused by the remote is not sent
+			name:   "warning",
+			acks:   "\x00\x01scp: a: Permission denied\n\x00\x00\x00",
+			stream: "D0755 0 d\nC0644 1 a\nC0644 1 b\nb\x00E\n",
+			files:  1,
+			warns:  []string{"scp: a: Permission denied"},
+		},
+		{
+			name:   "warning on directory",
+			acks:   "\x01scp: d: Permission denied\n",
+			stream: "D0755 0 d\n",
+			warns:  []string{"scp: d: Permission denied"},
+		},
+		{
+			name:   "abort on warning",
+			acks:   "\x00\x01scp: a: Permission denied\n",
+			abort:  true,
+			stream: "D0755 0 d\nC0644 1 a\n",
+			warns:  []string{"scp: a: Permission denied"},
+			err:    "scp: a: Permission denied",
+		},
+		{
+			name:   "fatal",
+			acks:   "\x00\x02scp: disk full\n",
+			stream: "D0755 0 d\nC0644 1 a\n",
+			err:    "scp: disk full",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			c := &Client{Options: Options{Quiet: true, AbortOnWarning: tc.abort}}
+			s := newTestSendState(&buf, tc.acks)
+
+			err := c.walkAndSend(s, &localSource{c: c, path: filepath.Join(dir, "d")})
+			if tc.err == "" && err != nil {
+				t.Errorf("got error %v", err)
+			}
+			if tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+				t.Errorf("got error %v, want %q", err, tc.err)
+			}
+			if buf.String() != tc.stream {
+				t.Errorf("got stream %q, want %q", buf.String(), tc.stream)
+			}
+			if s.stats.Files != tc.files {
+				t.Errorf("got %d files sent, want %d", s.stats.Files, tc.files)
+			}
+			if strings.Join(s.stats.Warnings, "|") != strings.Join(tc.warns, "|") {
+				t.Errorf("got warnings %q, want %q", s.stats.Warnings, tc.warns)
+			}
+		})
+	}
+}
+
+func TestShrunkFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "f")
+	if err := ioutil.WriteFile(path, []byte("abcde"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	c := &Client{Options: Options{Quiet: true}}
+	err = c.sendRegularFile(newTestSendState(&buf, ""), &localSource{c: c}, path, "f", fi)
+	if err == nil || !strings.Contains(err.Error(), "shrank") {
+		t.Errorf("got error %v, want a shrunk file error", err)
+	}
+	if want := "C0644 5 f\nab"; buf.String() != want {
+		t.Errorf("got stream %q, want %q", buf.String(), want)
+	}
+}
+
+func TestSendCommand(t *testing.T) {
+	for _, tc := range []struct {
+		c    *Client
+		dst  string
+		want string
+	}{
+		{&Client{}, "/tmp", "scp -rt /tmp"},
+		{&Client{PreseveTimes: true}, "/tmp", "scp -rtp /tmp"},
+		{&Client{PreseveTimes: true, Quiet: true}, "/tmp", "scp -rtpq /tmp"},
+		{&Client{Options: Options{PreserveTimes: true, Quiet: true}}, "/tmp", "scp -rtpq /tmp"},
+		{&Client{Options: Options{Quiet: true}}, "my dir", "scp -rtq 'my dir'"},
+		{&Client{Options: Options{ExtraArgs: []string{"-l", "8000"}}}, "/tmp", "scp -rt -l 8000 /tmp"},
+		{&Client{}, "foo; rm -rf /", "scp -rt 'foo; rm -rf /'"},
+		{&Client{}, "-oProxyCommand=sh", "scp -rt ./-oProxyCommand=sh"},
+		{&Client{Options: Options{ScpPath: "/opt/bin/scp"}}, "/tmp", "/opt/bin/scp -rt /tmp"},
+		{&Client{Options: Options{ScpPath: "my scp"}}, "/tmp", "'my scp' -rt /tmp"},
+	} {
+		// A directory is sent recursively
+		if got, err := tc.c.SendCommand(tc.dst, os.TempDir()); err != nil || got != tc.want {
+			t.Errorf("got %q, %v, want %q", got, err, tc.want)
+		}
+	}
+
+	// Clearing either the setting or its deprecated alias turns times off
+	for name, clear := range map[string]func(c *Client){
+		"PreserveTimes": func(c *Client) { c.PreserveTimes = false },
+		"PreseveTimes":  func(c *Client) { c.PreseveTimes = false },
+	} {
+		c := NewClient(nil, true)
+		if got, _ := c.SendCommand("/tmp", os.TempDir()); got != "scp -rtp /tmp" {
+			t.Errorf("got %q from NewClient, want -p", got)
+		}
+		clear(c)
+		if got, _ := c.SendCommand("/tmp", os.TempDir()); got != "scp -rt /tmp" {
+			t.Errorf("got %q once %s is cleared, want no -p", got, name)
+		}
+	}
+	c := NewClient(nil, false)
+	c.PreserveTimes = true
+	if got, _ := c.SendCommand("/tmp", os.TempDir()); got != "scp -rtp /tmp" {
+		t.Errorf("got %q once PreserveTimes is set, want -p", got)
+	}
+
+	// The flags Send works out from the paths
+	dir, err := ioutil.TempDir("", "scp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file, other := filepath.Join(dir, "f"), filepath.Join(dir, "g")
+	for _, p := range []string{file, other} {
+		if err := ioutil.WriteFile(p, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tc := range []struct {
+		c     *Client
+		paths []string
+		want  string
+	}{
+		{&Client{}, []string{file}, "scp -t /tmp"},
+		{&Client{}, []string{dir}, "scp -rt /tmp"},
+		{&Client{}, []string{file, other}, "scp -td /tmp"},
+		{&Client{}, []string{file, dir}, "scp -rtd /tmp"},
+		{&Client{}, []string{dir + "/"}, "scp -rtd /tmp"},
+		{&Client{Options: Options{Recursive: RecursiveAlways}}, []string{file}, "scp -rt /tmp"},
+		{&Client{Options: Options{Flatten: true}}, []string{dir}, "scp -td /tmp"},
+		{&Client{Options: Options{PathMapper: filepath.Base}}, []string{file}, "scp -rtd /tmp"},
+	} {
+		if got, err := tc.c.SendCommand("/tmp", tc.paths...); err != nil || got != tc.want {
+			t.Errorf("%v: got %q, %v, want %q", tc.paths, got, err, tc.want)
+		}
+	}
+
+	if _, err := c.SendCommand("/tmp"); err == nil {
+		t.Error("got no error without paths")
+	}
+	if _, err := c.SendCommand("", file); err == nil {
+		t.Error("got no error without a destination")
+	}
+}
+
+func TestManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.MkdirAll(filepath.Join(dir, "d", "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "d", "sub", "f"), []byte("hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	c := &Client{Options: Options{Quiet: true, ManifestName: "SUMS"}}
+	s := newTestSendState(&buf, "")
+	s.manifest = new(bytes.Buffer)
+	if err := c.walkAndSend(s, &localSource{c: c, path: filepath.Join(dir, "d")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.sendManifest(s); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03  d/sub/f\n"
+	if s.manifest.String() != want {
+		t.Errorf("got manifest %q, want %q", s.manifest.String(), want)
+	}
+	if !strings.HasSuffix(buf.String(), fmt.Sprintf("C0644 %d SUMS\n%s\x00", len(want), want)) {
+		t.Errorf("got %q sent, want the manifest last", buf.String())
+	}
+}
+
+func TestVerifyManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d := filepath.Join(dir, "d")
+	if err := os.Mkdir(d, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{"good": "hello\n", "bad": "changed\n", "unlisted": ""} {
+		if err := ioutil.WriteFile(filepath.Join(d, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	manifest, err := ParseManifest(strings.NewReader(
+		"5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03  d/good\n" +
+			"5891B5B522D5DF086D0FF0B110FBD9D21BB4FC7163AF34D08286A2E846F6BE03 *d/bad\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &Client{Options: Options{Quiet: true, VerifyManifest: manifest}}
+	sources := []Source{&localSource{c: c, path: d}}
+	hashes, err := c.hashFiles(sources, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.verifyManifest(hashes); err == nil || !strings.Contains(err.Error(), "d/bad, d/unlisted") {
+		t.Errorf("got error %v, want d/bad and d/unlisted mismatched", err)
+	}
+
+	c.SkipMismatched = true
+	c.SetLogger(log.New(ioutil.Discard, "", 0))
+	c.HashWorkers = 2
+	if hashes, err = c.hashFiles(sources, nil); err != nil {
+		t.Fatal(err)
+	}
+	mismatched, err := c.verifyManifest(hashes)
+	if err != nil || len(mismatched) != 2 || !mismatched["d/bad"] || !mismatched["d/unlisted"] {
+		t.Errorf("got %v, %v, want d/bad and d/unlisted mismatched", mismatched, err)
+	}
+
+	if _, err := ParseManifest(strings.NewReader("nothex  f\n")); err == nil {
+		t.Error("got no error for an invalid hash")
+	}
+}
+
+func TestMissingArguments(t *testing.T) {
+	c := &Client{}
+	if err := c.Send("", "file"); err == nil || !strings.Contains(err.Error(), "destination") {
+		t.Errorf("Send: got error %v, want a missing destination error", err)
+	}
+	if err := c.Receive("", "file"); err == nil || !strings.Contains(err.Error(), "destination") {
+		t.Errorf("Receive: got error %v, want a missing destination error", err)
+	}
+
+	if err := c.Send("/tmp"); err == nil {
+		t.Error("Send: got no error without paths")
+	}
+	if err := c.Receive("/tmp"); err == nil {
+		t.Error("Receive: got no error without paths")
+	}
+}
+
+func TestSendTrailingSlash(t *testing.T) {
+	if _, err := exec.LookPath("scp"); err != nil {
+		t.Skip("scp not available")
+	}
+	c := newTestClient(t)
+	defer c.SshClient.Close()
+
+	dir, err := ioutil.TempDir("", "scp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	for _, d := range []string{src, dst} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "f"), []byte("f"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Send(dst, src+"/"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Send(dst, src); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"f", "src/f"} {
+		if _, err := os.Stat(filepath.Join(dst, name)); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+
+	if err := c.Send(dst, filepath.Join(src, "f")+"/"); err == nil {
+		t.Error("got no error for a file with a trailing slash")
+	}
+}
+
+func TestSendContents(t *testing.T) {
+	if _, err := exec.LookPath("scp"); err != nil {
+		t.Skip("scp not available")
+	}
+	c := newTestClient(t)
+	defer c.SshClient.Close()
+
+	dir, err := ioutil.TempDir("", "scp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	for _, d := range []string{filepath.Join(src, "sub"), dst} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chmod(filepath.Join(src, "sub"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]os.FileMode{"a": 0640, "sub/b": 0755}
+	for name, mode := range files {
+		p := filepath.Join(src, filepath.FromSlash(name))
+		if err := ioutil.WriteFile(p, []byte(name), mode); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(p, mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := c.SendContents(dst, src); err != nil {
+		t.Fatal(err)
+	}
+	// The children of src land directly in dst
+	if _, err := os.Stat(filepath.Join(dst, "src")); !os.IsNotExist(err) {
+		t.Errorf("got %v for dst/src, want it missing", err)
+	}
+	for name, mode := range files {
+		p := filepath.Join(dst, filepath.FromSlash(name))
+		if data, err := ioutil.ReadFile(p); err != nil || string(data) != name {
+			t.Errorf("%s: got %q, %v, want %q", name, data, err, name)
+		}
+		if fi, err := os.Stat(p); err != nil {
+			t.Error(err)
+		} else if fi.Mode() != mode {
+			t.Errorf("%s: got mode %v, want %v", name, fi.Mode(), mode)
+		}
+	}
+	if fi, err := os.Stat(filepath.Join(dst, "sub")); err != nil || fi.Mode() != os.ModeDir|0750 {
+		t.Errorf("sub: got %v, %v, want mode %v", fi, err, os.ModeDir|0750)
+	}
+}
+
+func TestFlattenMissingDst(t *testing.T) {
+	if _, err := exec.LookPath("scp"); err != nil {
+		t.Skip("scp not available")
+	}
+	c := newTestClient(t)
+	defer c.SshClient.Close()
+
+	dir, err := ioutil.TempDir("", "scp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	if err := os.MkdirAll(filepath.Join(src, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "sub/b"} {
+		if err := ioutil.WriteFile(filepath.Join(src, filepath.FromSlash(name)), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Without a directory to go to, each file would overwrite the previous one
+	dst := filepath.Join(dir, "missing")
+	for name, cc := range map[string]*Client{
+		"Flatten":    c.WithOptions(Options{Quiet: true, Flatten: true}),
+		"PathMapper": c.WithOptions(Options{Quiet: true, PathMapper: filepath.Base}),
+	} {
+		if err := cc.Send(dst, src); err == nil {
+			t.Errorf("%s: got no error for a missing destination directory", name)
+		}
+		if _, err := os.Stat(dst); !os.IsNotExist(err) {
+			t.Errorf("%s: got %v for the destination, want it missing", name, err)
+		}
+	}
+}
+
+func TestRemotePath(t *testing.T) {
+	c := &Client{}
+	base := filepath.Join("src", "dir")
+	if got, err := c.remotePath(base, filepath.Join(base, "a", "b")); err != nil || got != "a/b" {
+		t.Errorf("got %q, %v, want a/b", got, err)
+	}
+
+	for mapped, want := range map[string]string{"x/y": "x/y", "x/./y/": "x/y", "../x": "", "/x": "", ".": ""} {
+		c.PathMapper = func(string) string { return mapped }
+		got, err := c.remotePath(base, filepath.Join(base, "f"))
+		if want == "" && err == nil {
+			t.Errorf("%s: got %q, want an error", mapped, got)
+		}
+		if want != "" && (err != nil || got != want) {
+			t.Errorf("%s: got %q, %v, want %q", mapped, got, err, want)
+		}
+	}
+}
+
+func TestWalkStream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	for _, d := range []string{"a/b/c", "z"} {
+		if err := os.MkdirAll(filepath.Join(src, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range []string{"a/b/y", "a/x", "ab", "z/w"} {
+		if err := ioutil.WriteFile(filepath.Join(src, f), []byte(f), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if info.IsDir() {
+			return os.Chmod(path, 0755)
+		}
+		return os.Chmod(path, 0644)
+	})
+
+	for _, tc := range []struct {
+		mapper func(string) string
+		want   string
+	}{
+		{nil, "D0755 0 src\nD0755 0 a\nD0755 0 b\nD0755 0 c\nE\nC0644 5 y\na/b/y\x00E\n" +
+			"C0644 3 x\na/x\x00E\nC0644 2 ab\nab\x00D0755 0 z\nC0644 3 w\nz/w\x00E\nE\n"},
+		// Leaving the tree for a new directory and coming back
+		{func(p string) string {
+			rel, _ := filepath.Rel(src, p)
+			if rel == "ab" {
+				return "k/ab"
+			}
+			return filepath.Join("m", "n", rel)
+		}, "D0755 0 m\nD0755 0 n\nD0755 0 a\nD0755 0 b\nD0755 0 c\nE\nC0644 5 y\na/b/y\x00E\n" +
+			"C0644 3 x\na/x\x00E\nE\nE\nD0755 0 k\nC0644 2 ab\nab\x00E\n" +
+			"D0755 0 m\nD0755 0 n\nD0755 0 z\nC0644 3 w\nz/w\x00E\nE\nE\n"},
+	} {
+		var buf bytes.Buffer
+		c := &Client{Options: Options{Quiet: true, PathMapper: tc.mapper}}
+		if err := c.walkAndSend(newTestSendState(&buf, ""), &localSource{c: c, path: src}); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != tc.want {
+			t.Errorf("got stream %q, want %q", buf.String(), tc.want)
+		}
+	}
+}
+
+// A Source of empty files in memory
+type memSource struct {
+	paths []string
+	dirs  map[string]bool
+}
+
+func (ms *memSource) Walk(fn func(path, remotePath string, info os.FileInfo) error) error {
+	for _, p := range ms.paths {
+		fi := &fileInfo{name: p[strings.LastIndex(p, "/")+1:], mode: 0644}
+		if ms.dirs[p] {
+			fi.mode = os.ModeDir | 0755
+		}
+		if err := fn(p, p, fi); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ms *memSource) Open(path string) (io.ReadCloser, error) {
+	return ioutil.NopCloser(strings.NewReader("")), nil
+}
+
+// The directories of a tree depth levels deep, each holding width files and,
+// but for the last one, width directories
+func newMemTree(prefix string, depth, width int, ms *memSource) {
+	for i := 0; i < width; i++ {
+		ms.paths = append(ms.paths, fmt.Sprintf("%sf%d", prefix, i))
+	}
+	if depth == 1 {
+		return
+	}
+	for i := 0; i < width; i++ {
+		dir := fmt.Sprintf("%sd%d", prefix, i)
+		ms.paths = append(ms.paths, dir)
+		ms.dirs[dir] = true
+		newMemTree(dir+"/", depth-1, width, ms)
+	}
+}
+
+// Endless acknowledgements
+type okReader struct{}
+
+func (okReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func BenchmarkWalkAndSend(b *testing.B) {
+	for _, tc := range []struct {
+		name         string
+		depth, width int
+	}{
+		{"wide", 2, 100},
+		{"deep", 12, 2},
+	} {
+		ms := &memSource{dirs: make(map[string]bool)}
+		newMemTree("", tc.depth, tc.width, ms)
+		c := &Client{Options: Options{Quiet: true}}
+		b.Run(tc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				s := &sendState{ctx: context.Background(), w: nullWriter{}, r: bufio.NewReader(okReader{}), sent: make(map[string]bool)}
+				if err := c.walkAndSend(s, ms); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// Logs from several goroutines
+type lockedLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *lockedLogger) Printf(format string, v ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+}
+
+func TestConcurrentSend(t *testing.T) {
+	if _, err := exec.LookPath("scp"); err != nil {
+		t.Skip("scp not available")
+	}
+	c := newTestClient(t)
+	defer c.SshClient.Close()
+
+	dir, err := ioutil.TempDir("", "scp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.Mkdir(filepath.Join(dir, "dst"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 8
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		src := filepath.Join(dir, fmt.Sprintf("src%d", i))
+		if err := ioutil.WriteFile(src, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- c.Send(filepath.Join(dir, "dst"), src)
+		}()
+	}
+	// The logger may change while the transfers run
+	logger := &lockedLogger{}
+	c.SetLogger(logger)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("src%d", i)
+		if b, err := ioutil.ReadFile(filepath.Join(dir, "dst", name)); err != nil || string(b) != filepath.Join(dir, name) {
+			t.Errorf("%s: got %q, %v", name, b, err)
+		}
+	}
+}
+
+func TestParallelSends(t *testing.T) {
+	if _, err := exec.LookPath("scp"); err != nil {
+		t.Skip("scp not available")
+	}
+	c := newTestClient(t)
+	defer c.SshClient.Close()
+
+	dir, err := ioutil.TempDir("", "scp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Every Send gets a tree with its own number of files, which OnComplete
+	// must see alone
+	const n = 16
+	for i := 0; i < n; i++ {
+		for j := 0; j <= i; j++ {
+			p := filepath.Join(dir, "src", fmt.Sprint(i), "sub", fmt.Sprint(j))
+			if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(p, []byte(p), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := os.MkdirAll(filepath.Join(dir, "dst", fmt.Sprint(i)), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var mu sync.Mutex
+	files := make(map[string]int)
+	c.PreserveTimes = true
+	// Shared by all the transfers
+	c.OnProgress = func(path string, sent, total int64) {}
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// Each transfer reports to its own callback
+			cc := c.WithOptions(c.Options)
+			name := fmt.Sprint(i)
+			cc.OnComplete = func(stats Stats, err error) {
+				mu.Lock()
+				files[name] = stats.Files
+				mu.Unlock()
+			}
+			// Repeated Sends of the same client don't see each other either
+			for k := 0; k < 2; k++ {
+				if err := cc.Send(filepath.Join(dir, "dst", name), filepath.Join(dir, "src", name)); err != nil {
+					t.Error(err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < n; i++ {
+		name := fmt.Sprint(i)
+		if files[name] != i+1 {
+			t.Errorf("Send %d: got %d files, want %d", i, files[name], i+1)
+		}
+		for j := 0; j <= i; j++ {
+			p := filepath.Join("src", name, "sub", fmt.Sprint(j))
+			if b, err := ioutil.ReadFile(filepath.Join(dir, "dst", name, name, "sub", fmt.Sprint(j))); err != nil || string(b) != filepath.Join(dir, p) {
+				t.Errorf("%s: got %q, %v", p, b, err)
+			}
+		}
+	}
+}
+
+func TestConcurrency(t *testing.T) {
+	if _, err := Dial("localhost", WithClientConfig(&ssh.ClientConfig{}), WithConcurrency(-1)); err == nil {
+		t.Error("got no error for a negative concurrency")
+	}
+
+	if _, err := exec.LookPath("scp"); err != nil {
+		t.Skip("scp not available")
+	}
+	c := newTestClient(t)
+	defer c.SshClient.Close()
+
+	dir, err := ioutil.TempDir("", "scp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(filepath.Join(dir, "dst"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for i := 0; i < 5; i++ {
+		p := filepath.Join(dir, fmt.Sprint(i))
+		if err := ioutil.WriteFile(p, []byte(p), 0644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, p)
+	}
+
+	var stats Stats
+	c.Concurrency = 3
+	c.OnComplete = func(s Stats, err error) { stats = s }
+	if err := c.Send(filepath.Join(dir, "dst"), paths...); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Files != len(paths) {
+		t.Errorf("got %d files, want %d", stats.Files, len(paths))
+	}
+	for _, p := range paths {
+		if b, err := ioutil.ReadFile(filepath.Join(dir, "dst", filepath.Base(p))); err != nil || string(b) != p {
+			t.Errorf("%s: got %q, %v", p, b, err)
+		}
+	}
+
+	// One of the sessions failing stops the others
+	err = c.Send(filepath.Join(dir, "dst"), append(paths, filepath.Join(dir, "missing"))...)
+	var pe *PartialError
+	if !errors.As(err, &pe) {
+		t.Errorf("got %v, want a *PartialError", err)
+	}
+}
+
+func TestClientContext(t *testing.T) {
+	if _, err := exec.LookPath("scp"); err != nil {
+		t.Skip("scp not available")
+	}
+	c := newTestClient(t)
+	defer c.SshClient.Close()
+
+	dir, err := ioutil.TempDir("", "scp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	if err := ioutil.WriteFile(src, []byte("src"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c.Context = ctx
+	if err := c.Send(filepath.Join(dir, "dst"), src); !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want %v", err, context.Canceled)
+	}
+	if err := c.ReceiveToWriterLimit(ioutil.Discard, src, 100); !errors.Is(err, context.Canceled) {
+		t.Errorf("ReceiveToWriterLimit: got %v, want %v", err, context.Canceled)
+	}
+	if err := c.ReceiveTar(filepath.Join(dir, "tar"), dir); !errors.Is(err, context.Canceled) {
+		t.Errorf("ReceiveTar: got %v, want %v", err, context.Canceled)
+	}
+	if err := c.SendReader(dir, "reader", strings.NewReader("x"), 1, 0644); !errors.Is(err, context.Canceled) {
+		t.Errorf("SendReader: got %v, want %v", err, context.Canceled)
+	}
+	// The context given takes precedence
+	if err := c.SendContext(context.Background(), filepath.Join(dir, "dst"), src); err != nil {
+		t.Error(err)
+	}
+}
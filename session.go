@@ -0,0 +1,91 @@
+package scp
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// How long NewSession waits by default for the server to accept a session, see
+// SessionWait
+const defaultSessionWait = 30 * time.Second
+
+// The sessions open on a connection, shared by the clients made from one another
+// with WithOptions. The semaphore holds a token per open session, it is sized by
+// the MaxSessions of the first client using it.
+type sessionSlots struct {
+	once sync.Once
+	sem  chan struct{}
+}
+
+// The sessions of the connection of c
+func (c *Client) slots() *sessionSlots {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sessions == nil {
+		c.sessions = &sessionSlots{}
+	}
+	return c.sessions
+}
+
+// Open a session for the client's own use, waiting for one of the MaxSessions to
+// be free, unless ctx is done first. release must be called once the session is
+// over.
+func (c *Client) openSession(ctx context.Context) (session *ssh.Session, release func(), err error) {
+	release = func() {}
+	if c.MaxSessions > 0 {
+		s := c.slots()
+		s.once.Do(func() { s.sem = make(chan struct{}, c.MaxSessions) })
+		select {
+		case s.sem <- struct{}{}:
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+
+		var once sync.Once
+		release = func() {
+			once.Do(func() { <-s.sem })
+		}
+	}
+
+	if session, err = c.newSession(ctx); err != nil {
+		release()
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
+		return nil, nil, errors.New("Failed to create SSH session: " + err.Error())
+	}
+	return session, release, nil
+}
+
+// Open a session, trying again while the server refuses it for having too many
+// open, for at most SessionWait or until ctx is done
+func (c *Client) newSession(ctx context.Context) (*ssh.Session, error) {
+	wait := c.SessionWait
+	if wait == 0 {
+		wait = defaultSessionWait
+	}
+	deadline := time.Now().Add(wait)
+
+	delay := 10 * time.Millisecond
+	for {
+		session, err := c.SshClient.NewSession()
+		var oce *ssh.OpenChannelError
+		if err == nil || !errors.As(err, &oce) || oce.Reason != ssh.Prohibited || time.Now().Add(delay).After(deadline) {
+			return session, err
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+		if delay *= 2; delay > time.Second {
+			delay = time.Second
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package scp
+
+import (
+	"io"
+	"os"
+)
+
+// Source provides the files and directories to send, see SendSource. Send uses
+// one reading the local file system.
+type Source interface {
+	// Walk calls fn for every regular file and directory to send, depth first,
+	// with the path to Open it by and the slash separated path it gets on the
+	// remote side, relative to the destination. A directory comes right before
+	// what it holds, and its content must be left out if fn returns
+	// filepath.SkipDir for it. Walk stops at the first other error of fn and
+	// returns it.
+	Walk(fn func(path, remotePath string, info os.FileInfo) error) error
+	// Open opens a regular file given by Walk
+	Open(path string) (io.ReadCloser, error)
+}
+
+// The Source of a local path given to Send
+type localSource struct {
+	c        *Client
+	path     string
+	contents bool
+}
+
+func (ls *localSource) Walk(fn func(path, remotePath string, info os.FileInfo) error) error {
+	return ls.c.walk(ls.path, ls.contents, fn)
+}
+
+func (ls *localSource) Open(path string) (io.ReadCloser, error) {
+	return os.Open(path)
+}
+
+// SendSource sends the entries of the sources into the remote dst directory, as
+// Send does with local files: in a single session, or with Concurrency spread over
+// several, each source being sent whole by one of them. PathMapper and Flatten
+// only apply to local files, a Source decides of the remote paths itself.
+func (c *Client) SendSource(dst string, sources ...Source) error {
+	_, err := c.sendSources(c.context(), dst, sources, c.Recursive != RecursiveNever, true, nil)
+	return err
+}
@@ -0,0 +1,258 @@
+package scp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// fileWriter streams the body of a single file to the remote side
+type fileWriter struct {
+	c       *Client
+	ss      *scpSession
+	path    string
+	size    int64
+	written int64
+	closed  bool
+	report  func(path string, written, total int64)
+	start   time.Time
+}
+
+// SendWriter creates the file name in the remote dst directory and returns a writer
+// for its content, which must be exactly size bytes long. The transfer completes,
+// or fails, when the writer is closed. If PreserveTimes is set the file gets the
+// current time.
+func (c *Client) SendWriter(dst, name string, size int64, mode os.FileMode) (io.WriteCloser, error) {
+	fw, err := c.sendWriter(dst, name, size, mode, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return fw, nil
+}
+
+// Start sending a single file, with mtime as its modification time
+func (c *Client) sendWriter(dst, name string, size int64, mode os.FileMode, mtime time.Time) (*fileWriter, error) {
+	if dst == "" {
+		return nil, errors.New("Missing remote destination")
+	}
+	dst, err := c.expandRemotePath(dst)
+	if err != nil {
+		return nil, err
+	}
+
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\n") {
+		return nil, errors.New("Invalid file name: " + name)
+	}
+	if size < 0 {
+		return nil, errors.New("Invalid file size")
+	}
+
+	ss, err := c.startSession(c.context(), c.sendCommand(dst, c.Recursive == RecursiveAlways, false))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.writeHeader(ss, name, size, mode, mtime); err != nil {
+		c.abort(ss)
+		return nil, err
+	}
+
+	fw := &fileWriter{c: c, ss: ss, path: name, size: size, report: c.progress(false), start: time.Now()}
+	c.logEvent(LogEvent{Event: EventFileStart, Path: name})
+	if fw.report != nil {
+		fw.report(name, 0, size)
+	}
+	return fw, nil
+}
+
+// Wait for the remote to be ready and send the headers of a single file
+func (c *Client) writeHeader(ss *scpSession, name string, size int64, mode os.FileMode, mtime time.Time) error {
+	if err := c.recvAck(ss.stdout); err != nil {
+		return err
+	}
+
+	// Both records are built in one buffer, with no formatting through fmt
+	hdr := make([]byte, 0, 64+len(name))
+	if c.preserveTimes() {
+		hdr = append(hdr, 'T')
+		hdr = strconv.AppendInt(hdr, mtime.Unix(), 10)
+		hdr = append(hdr, " 0 "...)
+		hdr = strconv.AppendInt(hdr, time.Now().Unix(), 10)
+		hdr = append(hdr, " 0\n"...)
+		if err := c.sendRecord(ss.stdin, string(hdr)); err != nil {
+			return errors.New("Copy failed: " + err.Error())
+		}
+		if err := c.recvAck(ss.stdout); err != nil {
+			return err
+		}
+		hdr = hdr[:0]
+	}
+
+	hdr = append(hdr, 'C')
+	hdr = c.appendMode(hdr, mode)
+	hdr = append(hdr, ' ')
+	hdr = strconv.AppendInt(hdr, size, 10)
+	hdr = append(hdr, ' ')
+	hdr = append(hdr, name...)
+	hdr = append(hdr, '\n')
+	if err := c.sendRecord(ss.stdin, string(hdr)); err != nil {
+		return errors.New("Copy failed: " + err.Error())
+	}
+	return c.recvAck(ss.stdout)
+}
+
+func (fw *fileWriter) Write(p []byte) (int, error) {
+	if fw.closed {
+		return 0, errors.New("Write on closed writer")
+	}
+
+	tooLong := false
+	if left := fw.size - fw.written; int64(len(p)) > left {
+		p = p[:left]
+		tooLong = true
+	}
+
+	n, err := fw.ss.stdin.Write(p)
+	fw.written += int64(n)
+	if fw.report != nil && n > 0 {
+		fw.report(fw.path, fw.written, fw.size)
+	}
+	if err != nil {
+		return n, errors.New("Copy failed: " + err.Error())
+	}
+	if tooLong {
+		return n, fmt.Errorf("Write exceeds the declared size of %d bytes", fw.size)
+	}
+	return n, nil
+}
+
+// Close completes the transfer. It fails, and the remote file is left incomplete,
+// if fewer bytes than declared were written.
+func (fw *fileWriter) Close() error {
+	if fw.closed {
+		return nil
+	}
+	fw.closed = true
+
+	if fw.written != fw.size {
+		fw.c.abort(fw.ss)
+		return fmt.Errorf("Short write: %d bytes written out of %d", fw.written, fw.size)
+	}
+
+	if err := fw.c.sendAck(fw.ss.stdin); err != nil {
+		fw.c.abort(fw.ss)
+		return errors.New("Copy failed: " + err.Error())
+	}
+	if err := fw.c.recvAck(fw.ss.stdout); err != nil {
+		fw.c.abort(fw.ss)
+		return err
+	}
+
+	fw.c.logEvent(LogEvent{Event: EventFileCopied, Path: fw.path, Bytes: fw.size, Duration: time.Since(fw.start)})
+	fw.c.infof("Copied: %s", fw.path)
+	ctx := fw.c.context()
+	err := fw.c.finish(ctx, fw.ss)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// SendReader creates the file name in the remote dst directory with the content
+// read from r, which must provide at least size bytes.
+func (c *Client) SendReader(dst, name string, r io.Reader, size int64, mode os.FileMode) error {
+	w, err := c.SendWriter(dst, name, size, mode)
+	if err != nil {
+		return err
+	}
+
+	buf := getCopyBuffer(c.BufferSize)
+	defer putCopyBuffer(buf)
+	if _, err := copyN(w, r, size, *buf); err != nil {
+		w.Close()
+		if err == io.EOF {
+			return fmt.Errorf("Reader provided less than %d bytes", size)
+		}
+		return err
+	}
+	return w.Close()
+}
+
+// SendReaderInfo creates a file in the remote dst directory with the content read
+// from r, taking its name, size, mode and modification time from fi. r must
+// provide exactly fi.Size() bytes, the transfer fails otherwise.
+func (c *Client) SendReaderInfo(dst string, r io.Reader, fi os.FileInfo) error {
+	if !fi.Mode().IsRegular() {
+		return errors.New("Not a regular file: " + fi.Name())
+	}
+	mtime := fi.ModTime()
+	if mtime.IsZero() {
+		mtime = time.Now()
+	}
+
+	fw, err := c.sendWriter(dst, fi.Name(), fi.Size(), fi.Mode(), mtime)
+	if err != nil {
+		return err
+	}
+
+	buf := getCopyBuffer(c.BufferSize)
+	defer putCopyBuffer(buf)
+	if _, err := copyN(fw, r, fi.Size(), *buf); err != nil {
+		fw.Close()
+		if err == io.EOF {
+			return fmt.Errorf("Reader provided less than %d bytes", fi.Size())
+		}
+		return err
+	}
+	// Leftover data means fi doesn't describe the content, don't complete it
+	if n, _ := io.ReadFull(r, make([]byte, 1)); n > 0 {
+		fw.closed = true
+		c.abort(fw.ss)
+		return fmt.Errorf("Reader provided more than %d bytes", fi.Size())
+	}
+	return fw.Close()
+}
+
+// SendBuffer creates the file name in the remote dst directory with the unread
+// content of buf, which is drained.
+func (c *Client) SendBuffer(dst, name string, buf *bytes.Buffer, mode os.FileMode) error {
+	return c.SendReader(dst, name, buf, int64(buf.Len()), mode)
+}
+
+// SendStdin creates the file name in the remote dst directory with everything read
+// from the standard input. Since scp needs to know the size of a file before
+// sending it, standard input is first copied to a temporary file, which is removed
+// afterwards. Use SendStdinSized when the size is known in advance.
+func (c *Client) SendStdin(dst, name string, mode os.FileMode) error {
+	tmp, err := ioutil.TempFile("", "scp-stdin")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	buf := getCopyBuffer(c.BufferSize)
+	defer putCopyBuffer(buf)
+	size, err := copyBuffer(tmp, os.Stdin, *buf)
+	if err != nil {
+		return errors.New("Failed to read stdin: " + err.Error())
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	return c.SendReader(dst, name, tmp, size, mode)
+}
+
+// SendStdinSized creates the file name in the remote dst directory with size bytes
+// read from the standard input, without buffering it. The size must be accurate:
+// the transfer fails if stdin ends early, and anything past size is left unread.
+func (c *Client) SendStdinSized(dst, name string, size int64, mode os.FileMode) error {
+	return c.SendReader(dst, name, os.Stdin, size, mode)
+}
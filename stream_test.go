@@ -0,0 +1,102 @@
+package scp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSendBuffer(t *testing.T) {
+	if _, err := exec.LookPath("scp"); err != nil {
+		t.Skip("scp not available")
+	}
+	c := newTestClient(t)
+	defer c.SshClient.Close()
+
+	dir, err := ioutil.TempDir("", "scp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var buf bytes.Buffer
+	buf.WriteString("generated content\n")
+	if err := c.SendBuffer(dir, "out.txt", &buf, 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join(dir, "out.txt")
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "generated content\n" {
+		t.Errorf("got %q, want %q", data, "generated content\n")
+	}
+	fi, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0640 {
+		t.Errorf("got mode %v, want %v", fi.Mode().Perm(), os.FileMode(0640))
+	}
+}
+
+func TestSendReaderInfo(t *testing.T) {
+	if _, err := exec.LookPath("scp"); err != nil {
+		t.Skip("scp not available")
+	}
+	c := newTestClient(t)
+	defer c.SshClient.Close()
+	c.PreserveTimes = true
+
+	dir, err := ioutil.TempDir("", "scp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mtime := time.Unix(1500000000, 0)
+	fi := &fileInfo{name: "entry", size: 5, mode: 0600, modTime: mtime}
+	if err := c.SendReaderInfo(dir, strings.NewReader("hello"), fi); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.Stat(filepath.Join(dir, "entry"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Size() != 5 || got.Mode().Perm() != 0600 || !got.ModTime().Equal(mtime) {
+		t.Errorf("got size %d, mode %v, time %v, want 5, %v, %v", got.Size(), got.Mode().Perm(), got.ModTime(), os.FileMode(0600), mtime)
+	}
+
+	if err := c.SendReaderInfo(dir, strings.NewReader("hell"), fi); err == nil {
+		t.Error("got no error for a short reader")
+	}
+	if err := c.SendReaderInfo(dir, strings.NewReader("hello!"), fi); err == nil {
+		t.Error("got no error for a long reader")
+	}
+}
+
+func BenchmarkSendReader(b *testing.B) {
+	if _, err := exec.LookPath("scp"); err != nil {
+		b.Skip("scp not available")
+	}
+	c := newTestClient(b)
+	defer c.SshClient.Close()
+
+	body := make([]byte, 16<<20)
+	b.SetBytes(int64(len(body)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// The remote scp writes the file to /dev/null
+		if err := c.SendReader("/dev/null", "body", bytes.NewReader(body), int64(len(body)), 0644); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package scp
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// SyncPolicy decides which side of a Sync wins for a file which differs between
+// the two
+type SyncPolicy int
+
+const (
+	// NewerWins keeps the file with the latest modification time
+	NewerWins SyncPolicy = iota
+	// LocalWins makes the local directory the reference
+	LocalWins
+	// RemoteWins makes the remote directory the reference
+	RemoteWins
+)
+
+// SyncOptions configure Sync
+type SyncOptions struct {
+	Policy SyncPolicy
+	// Delete removes the files which only exist on the losing side, rather
+	// than copying them over. It requires LocalWins or RemoteWins, with
+	// NewerWins there is no telling a new file from a deleted one.
+	Delete bool
+}
+
+// Sync reconciles the regular files of localDir and remoteDir in both directions.
+// Files are compared by size and modification time, at second precision, and a
+// file which differs is copied over from the side chosen by the policy. A file
+// found on one side only is copied to the other, or removed with Delete, which
+// leaves directories in place. Modification times are preserved both ways so
+// that the next Sync finds the files unchanged. Each file is copied in a session
+// of its own, with only Quiet, ScpPath, ExtraArgs, BufferSize and Context taken
+// from the client's settings.
+func (c *Client) Sync(localDir, remoteDir string, opts SyncOptions) error {
+	if opts.Delete && opts.Policy == NewerWins {
+		return errors.New("Sync can't delete files with the NewerWins policy")
+	}
+
+	local, err := listLocalTree(localDir)
+	if err != nil {
+		return err
+	}
+	// The listing must be of the directory Send expands ~ to
+	if remoteDir, err = c.expandRemotePath(remoteDir); err != nil {
+		return err
+	}
+	remote, err := c.listRemoteTree(remoteDir)
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(local)+len(remote))
+	for name := range local {
+		names = append(names, name)
+	}
+	for name := range remote {
+		if _, ok := local[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	// Copy with settings of its own: conflict policies, backups and path
+	// rewriting would leave the two sides different from what was compared
+	cc := c.WithOptions(Options{
+		PreserveTimes: true,
+		Quiet:         c.quiet(),
+		ScpPath:       c.ScpPath,
+		ExtraArgs:     c.ExtraArgs,
+		BufferSize:    c.BufferSize,
+		Context:       c.Context,
+		OnConflict:    Overwrite,
+	})
+
+	for _, name := range names {
+		lfi, inLocal := local[name]
+		rfi, inRemote := remote[name]
+		localPath := filepath.Join(localDir, filepath.FromSlash(name))
+		remotePath := path.Join(remoteDir, name)
+
+		if inLocal && inRemote && lfi.IsDir() != rfi.IsDir() {
+			return errors.New("Sync conflict, file and directory: " + name)
+		}
+		if (inLocal && lfi.IsDir()) || (inRemote && rfi.IsDir()) {
+			// Directories are created along with the files they hold
+			continue
+		}
+
+		upload := false
+		switch {
+		case inLocal && inRemote:
+			if lfi.Size() == rfi.Size() && lfi.ModTime().Unix() == rfi.ModTime().Unix() {
+				continue
+			}
+			switch opts.Policy {
+			case LocalWins:
+				upload = true
+			case RemoteWins:
+				upload = false
+			default:
+				upload = lfi.ModTime().After(rfi.ModTime())
+			}
+		case inLocal:
+			if opts.Delete && opts.Policy == RemoteWins {
+				if err := os.Remove(localPath); err != nil {
+					return err
+				}
+				continue
+			}
+			upload = true
+		default:
+			if opts.Delete && opts.Policy == LocalWins {
+				if err := c.Remove(remotePath); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+
+		if upload {
+			if err := c.MkdirAll(path.Dir(remotePath), 0755); err != nil {
+				return err
+			}
+			if err := cc.Send(path.Dir(remotePath), localPath); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+			return err
+		}
+		if err := cc.Receive(filepath.Dir(localPath), remotePath); err != nil {
+			return err
+		}
+		if err := os.Chtimes(localPath, rfi.ModTime(), rfi.ModTime()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// List the regular files and directories under localDir, by slash separated path
+// relative to it
+func listLocalTree(localDir string) (map[string]os.FileInfo, error) {
+	tree := make(map[string]os.FileInfo)
+	err := filepath.Walk(localDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == localDir || (!info.Mode().IsRegular() && !info.IsDir()) {
+			return nil
+		}
+		rel, err := filepath.Rel(localDir, p)
+		if err != nil {
+			return err
+		}
+		tree[filepath.ToSlash(rel)] = info
+		return nil
+	})
+	if err != nil {
+		return nil, errors.New("Failed to list local files: " + err.Error())
+	}
+	return tree, nil
+}
+
+// List the regular files and directories under remoteDir, by path relative to it,
+// with a single run of GNU find. A missing remoteDir is empty.
+func (c *Client) listRemoteTree(remoteDir string) (map[string]os.FileInfo, error) {
+	q := quotePath(remoteDir)
+	out, _, err := c.RunCommand(fmt.Sprintf("[ -e %s ] || exit 0; [ -d %s ] || exit %d; "+
+		"exec find %s -mindepth 1 \\( -type f -o -type d \\) -printf '%%s %%m %%T@ %%y %%P\\0'",
+		q, q, notDirStatus, q))
+	if err != nil {
+		return nil, remotePathError("list", remoteDir, err)
+	}
+
+	tree := make(map[string]os.FileInfo)
+	for _, entry := range strings.Split(string(out), "\x00") {
+		if entry == "" {
+			continue
+		}
+		fi, err := parseFindEntry(entry)
+		if err != nil {
+			return nil, err
+		}
+		tree[fi.name] = fi
+	}
+	return tree, nil
+}
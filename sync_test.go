@@ -0,0 +1,113 @@
+package scp
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestSyncIgnoresSettings(t *testing.T) {
+	if _, err := exec.LookPath("scp"); err != nil {
+		t.Skip("scp not available")
+	}
+	c := newTestClient(t)
+	defer c.SshClient.Close()
+	// Neither may leave extra files behind for the next Sync to copy
+	c.OnConflict = Rename
+	c.Backup = true
+
+	dir, err := ioutil.TempDir("", "scp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	local, remote := filepath.Join(dir, "local"), filepath.Join(dir, "remote")
+
+	// a is newer on the remote side, b on the local side
+	old, recent := time.Now().Add(-time.Hour), time.Now().Add(-time.Minute)
+	for _, f := range []struct {
+		path, data string
+		mtime      time.Time
+	}{
+		{filepath.Join(local, "a"), "old a", old},
+		{filepath.Join(remote, "a"), "new a", recent},
+		{filepath.Join(local, "b"), "new b", recent},
+		{filepath.Join(remote, "b"), "old b", old},
+	} {
+		if err := os.MkdirAll(filepath.Dir(f.path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(f.path, []byte(f.data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(f.path, f.mtime, f.mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := c.Sync(local, remote, SyncOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []string{local, remote} {
+		infos, err := ioutil.ReadDir(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, fi := range infos {
+			names = append(names, fi.Name())
+		}
+		sort.Strings(names)
+		if len(names) != 2 || names[0] != "a" || names[1] != "b" {
+			t.Errorf("%s: got %v, want [a b]", d, names)
+		}
+		for name, want := range map[string]string{"a": "new a", "b": "new b"} {
+			if data, err := ioutil.ReadFile(filepath.Join(d, name)); err != nil || string(data) != want {
+				t.Errorf("%s/%s: got %q, %v, want %q", d, name, data, err, want)
+			}
+		}
+	}
+}
+
+func TestSyncHome(t *testing.T) {
+	if _, err := exec.LookPath("scp"); err != nil {
+		t.Skip("scp not available")
+	}
+	dir, err := ioutil.TempDir("", "scp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// The remote side is this machine, with dir as its home
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	os.Setenv("HOME", dir)
+	c := newTestClient(t)
+	defer c.SshClient.Close()
+
+	local, remote := filepath.Join(dir, "local"), filepath.Join(dir, "remote")
+	for _, d := range []string{local, remote} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(local, "l"), []byte("l"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(remote, "r"), []byte("r"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The files already under ~/remote are found
+	if err := c.Sync(local, "~/remote", SyncOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{filepath.Join(local, "r"), filepath.Join(remote, "l")} {
+		if _, err := os.Stat(p); err != nil {
+			t.Error(err)
+		}
+	}
+}
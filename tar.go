@@ -0,0 +1,134 @@
+package scp
+
+import (
+	"archive/tar"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ReceiveTar copies the content of the remote directory remotePath into the local
+// localDst directory, which is created if needed, as a tar stream made by the
+// remote tar command. With many small files this is much faster than Receive.
+// Modes and modification times are preserved. Only regular files and directories
+// are extracted, and entries which would land outside localDst are refused. It
+// requires tar on the remote side, any POSIX tar will do.
+func (c *Client) ReceiveTar(localDst, remotePath string) error {
+	if localDst == "" {
+		return errors.New("Missing local destination")
+	}
+
+	ctx := c.context()
+	ss, err := c.startSession(ctx, "tar -cf - -C "+quotePath(remotePath)+" .")
+	if err != nil {
+		return err
+	}
+	defer ss.session.Close()
+	defer closeOnCancel(ctx, ss)()
+
+	if err := c.extractTar(ss.stdout, localDst); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		c.abort(ss)
+		if msg := strings.TrimSpace(ss.stderr.String()); msg != "" {
+			err = errors.New(err.Error() + " (remote: " + msg + ")")
+		}
+		return err
+	}
+	err = c.finish(ctx, ss)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// Extract the tar stream read from r into dst
+func (c *Client) extractTar(r io.Reader, dst string) error {
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return err
+	}
+
+	// Directories get their mode and times once their content is in place,
+	// which would otherwise change the times and may need write access
+	type dirAttrs struct {
+		path  string
+		mode  os.FileMode
+		mtime time.Time
+	}
+	var dirs []dirAttrs
+
+	buf := getCopyBuffer(c.BufferSize)
+	defer putCopyBuffer(buf)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.New("Failed to read tar stream: " + err.Error())
+		}
+
+		name := path.Clean(hdr.Name)
+		if name == "." || name == "/" {
+			continue
+		}
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return errors.New("Refusing tar entry outside the destination: " + hdr.Name)
+		}
+		target := filepath.Join(dst, filepath.FromSlash(name))
+		mode := hdr.FileInfo().Mode().Perm()
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0700); err != nil {
+				return err
+			}
+			dirs = append(dirs, dirAttrs{target, mode, hdr.ModTime})
+		case tar.TypeReg:
+			if err := extractTarFile(tr, target, mode, hdr, *buf); err != nil {
+				return err
+			}
+			c.infof("Received: %s", target)
+		default:
+			c.warnf("Skipped: %s, not a regular file or directory", name)
+		}
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		d := dirs[i]
+		if err := os.Chmod(d.path, d.mode); err != nil {
+			return err
+		}
+		if err := os.Chtimes(d.path, d.mtime, d.mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write the current entry of tr to target, copying through buf
+func extractTarFile(tr *tar.Reader, target string, mode os.FileMode, hdr *tar.Header, buf []byte) error {
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := copyBuffer(f, tr, buf); err != nil {
+		f.Close()
+		return errors.New("Failed to read tar stream: " + err.Error())
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	// OpenFile only applies the mode to new files, and through the umask
+	if err := os.Chmod(target, mode); err != nil {
+		return err
+	}
+	return os.Chtimes(target, hdr.ModTime, hdr.ModTime)
+}
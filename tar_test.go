@@ -0,0 +1,40 @@
+package scp
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExtractTarTraversal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dst := filepath.Join(dir, "dst")
+
+	for _, name := range []string{"../evil", "a/../../evil", "/evil"} {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		tw.WriteHeader(&tar.Header{Name: "./ok", Typeflag: tar.TypeReg, Mode: 0644, Size: 2})
+		tw.Write([]byte("ok"))
+		tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: 4})
+		tw.Write([]byte("evil"))
+		tw.Close()
+
+		c := &Client{Options: Options{Quiet: true}}
+		if err := c.extractTar(&buf, dst); err == nil {
+			t.Errorf("%s: got no error", name)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "evil")); err == nil {
+			t.Fatalf("%s: extracted outside the destination", name)
+		}
+		if data, err := ioutil.ReadFile(filepath.Join(dst, "ok")); err != nil || string(data) != "ok" {
+			t.Errorf("%s: got %q, %v for the valid entry", name, data, err)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package scp
+
+import (
+	"context"
+	"sync"
+)
+
+// Size of the chunks file bodies are copied in when a transfer can be paused and
+// ChunkSize is not set
+const pauseChunkSize = 256 << 10
+
+// Transfer is a Send running in the background, which can be paused
+type Transfer struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+	stats  Stats
+	err    error
+
+	mu sync.Mutex
+	// resume is closed by Resume, nil while running
+	resume chan struct{}
+}
+
+// StartSend starts sending the paths to dst in the background, like SendWithStats,
+// and returns a handle to control the transfer. It stops when ctx is done.
+func (c *Client) StartSend(ctx context.Context, dst string, paths ...string) *Transfer {
+	ctx, cancel := context.WithCancel(ctx)
+	t := &Transfer{cancel: cancel, done: make(chan struct{})}
+
+	go func() {
+		defer close(t.done)
+		defer cancel()
+		t.stats, t.err = c.send(ctx, dst, false, paths, t)
+	}()
+	return t
+}
+
+// Pause suspends the transfer before the next chunk of data is sent. Nothing goes
+// through the connection in the meantime, so a remote scp with a read timeout, or
+// a server closing idle connections, may give up if paused for too long.
+func (t *Transfer) Pause() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.resume == nil {
+		t.resume = make(chan struct{})
+	}
+}
+
+// Resume carries on with a paused transfer
+func (t *Transfer) Resume() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.resume != nil {
+		close(t.resume)
+		t.resume = nil
+	}
+}
+
+// Paused reports whether the transfer is paused
+func (t *Transfer) Paused() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.resume != nil
+}
+
+// Cancel aborts the transfer, even a paused one
+func (t *Transfer) Cancel() {
+	t.cancel()
+}
+
+// Done is closed once the transfer is over
+func (t *Transfer) Done() <-chan struct{} {
+	return t.done
+}
+
+// Wait waits for the transfer to be over and returns its statistics and error, as
+// SendWithStats does
+func (t *Transfer) Wait() (Stats, error) {
+	<-t.done
+	return t.stats, t.err
+}
+
+// Block while the transfer is paused
+func (t *Transfer) wait(ctx context.Context) error {
+	t.mu.Lock()
+	resume := t.resume
+	t.mu.Unlock()
+
+	if resume == nil {
+		return nil
+	}
+	select {
+	case <-resume:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,78 @@
+package scp
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTransferPause(t *testing.T) {
+	if _, err := exec.LookPath("scp"); err != nil {
+		t.Skip("scp not available")
+	}
+	c := newTestClient(t)
+	defer c.SshClient.Close()
+
+	dir, err := ioutil.TempDir("", "scp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	if err := os.Mkdir(dst, 0755); err != nil {
+		t.Fatal(err)
+	}
+	body := bytes.Repeat([]byte("0123456789abcdef"), 1<<16)
+	if err := ioutil.WriteFile(src, body, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Pause once the first chunk is sent, holding the transfer until then
+	var sent int64
+	reached, paused := make(chan struct{}), make(chan struct{})
+	c.ChunkSize = 64 << 10
+	c.OnProgress = func(path string, n, total int64) {
+		atomic.StoreInt64(&sent, n)
+		if n == c.ChunkSize {
+			close(reached)
+			<-paused
+		}
+	}
+
+	tr := c.StartSend(context.Background(), dst, src)
+	<-reached
+	tr.Pause()
+	close(paused)
+	if !tr.Paused() {
+		t.Error("not paused after Pause")
+	}
+
+	// Nothing moves while paused
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt64(&sent); n != c.ChunkSize {
+		t.Errorf("got %d bytes sent while paused, want %d", n, c.ChunkSize)
+	}
+	select {
+	case <-tr.Done():
+		t.Fatal("the paused transfer is over")
+	default:
+	}
+
+	tr.Resume()
+	stats, err := tr.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Bytes != int64(len(body)) || atomic.LoadInt64(&sent) != int64(len(body)) {
+		t.Errorf("got %d bytes in the stats and %d reported, want %d", stats.Bytes, sent, len(body))
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dst, "src")); err != nil || !bytes.Equal(data, body) {
+		t.Errorf("got %d bytes, %v on the remote side, want %d", len(data), err, len(body))
+	}
+}
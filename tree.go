@@ -0,0 +1,210 @@
+package scp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// TreeEntry is a file or directory of a tree built in memory, see SendTree
+type TreeEntry struct {
+	// Path is the slash separated path of the entry, relative to the destination
+	Path string
+	Mode os.FileMode
+	// ModTime is sent with PreserveTimes, the current time if zero
+	ModTime time.Time
+	// Reader provides the Size bytes of a file, it is nil for a directory
+	Reader io.Reader
+	Size   int64
+}
+
+// SendTree creates the entries in the remote dst directory, in a single session.
+// The entries may come in any order. Directories holding files don't need an
+// entry of their own, they are created with mode 0755, but an entry is needed to
+// create an empty directory or give it another mode. The transfer stops at the
+// first file or directory the remote side refuses.
+func (c *Client) SendTree(dst string, entries []TreeEntry) error {
+	if dst == "" {
+		return errors.New("Missing remote destination")
+	}
+	entries, err := sortTree(entries)
+	if err != nil {
+		return err
+	}
+	if dst, err = c.expandRemotePath(dst); err != nil {
+		return err
+	}
+
+	ss, err := c.startSession(c.context(), c.sendCommand(dst, true, true))
+	if err != nil {
+		return err
+	}
+	defer ss.session.Close()
+	ctx := c.context()
+	defer closeOnCancel(ctx, ss)()
+
+	s := &sendState{ctx: ctx, w: ss.stdin, r: ss.stdout}
+	if err := c.sendTree(s, entries); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		ss.stdin.Close()
+		c.wait(ctx, ss)
+		if msg := strings.TrimSpace(ss.stderr.String()); msg != "" {
+			err = fmt.Errorf("%w (remote: %s)", err, msg)
+		}
+		return err
+	}
+	return c.finish(ctx, ss)
+}
+
+// Check the entries and sort them so that everything under a directory comes
+// right after it
+func sortTree(entries []TreeEntry) ([]TreeEntry, error) {
+	sorted := make([]TreeEntry, len(entries))
+	for i, e := range entries {
+		p := path.Clean(e.Path)
+		if e.Path == "" || p == "." || path.IsAbs(p) || p == ".." || strings.HasPrefix(p, "../") ||
+			strings.Contains(p, "\n") {
+			return nil, errors.New("Invalid tree entry path: " + e.Path)
+		}
+		if e.Reader != nil && e.Size < 0 {
+			return nil, errors.New("Invalid file size for " + e.Path)
+		}
+		e.Path = p
+		sorted[i] = e
+	}
+
+	// Comparing element by element keeps a/b next to a, before a.txt
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := strings.Split(sorted[i].Path, "/"), strings.Split(sorted[j].Path, "/")
+		for k := 0; k < len(a) && k < len(b); k++ {
+			if a[k] != b[k] {
+				return a[k] < b[k]
+			}
+		}
+		return len(a) < len(b)
+	})
+
+	for i := 1; i < len(sorted); i++ {
+		prev, e := sorted[i-1], sorted[i]
+		if e.Path == prev.Path {
+			return nil, errors.New("Duplicate tree entry: " + e.Path)
+		}
+		if prev.Reader != nil && strings.HasPrefix(e.Path, prev.Path+"/") {
+			return nil, errors.New("Tree entry inside a file: " + e.Path)
+		}
+	}
+	return sorted, nil
+}
+
+// Send the sorted entries, entering and leaving directories as needed
+func (c *Client) sendTree(s *sendState, entries []TreeEntry) error {
+	if err := c.recvAck(s.r); err != nil {
+		return err
+	}
+
+	var dirStack []string
+	for _, e := range entries {
+		elems := strings.Split(e.Path, "/")
+		parents := elems[:len(elems)-1]
+		if e.Reader == nil {
+			parents = elems
+		}
+
+		common := 0
+		for common < len(dirStack) && common < len(parents) && dirStack[common] == parents[common] {
+			common++
+		}
+		for len(dirStack) > common {
+			if err := c.sendTreeRecord(s, "E\n"); err != nil {
+				return err
+			}
+			c.logEvent(LogEvent{Event: EventDirExit, Path: strings.Join(dirStack, "/")})
+			dirStack = dirStack[:len(dirStack)-1]
+		}
+
+		for len(dirStack) < len(parents) {
+			mode, mtime := os.FileMode(0755), time.Time{}
+			if len(dirStack) == len(parents)-1 && e.Reader == nil {
+				mode, mtime = e.Mode, e.ModTime
+			}
+			if err := c.sendTreeTimes(s, mtime); err != nil {
+				return err
+			}
+			name := parents[len(dirStack)]
+			if err := c.sendTreeRecord(s, fmt.Sprintf("D%s 0 %s\n", c.formatMode(mode), name)); err != nil {
+				return err
+			}
+			dirStack = append(dirStack, name)
+			c.logEvent(LogEvent{Event: EventDirEnter, Path: strings.Join(dirStack, "/")})
+		}
+
+		if e.Reader != nil {
+			if err := c.sendTreeFile(s, e, elems[len(elems)-1]); err != nil {
+				return err
+			}
+		}
+	}
+
+	for len(dirStack) > 0 {
+		if err := c.sendTreeRecord(s, "E\n"); err != nil {
+			return err
+		}
+		c.logEvent(LogEvent{Event: EventDirExit, Path: strings.Join(dirStack, "/")})
+		dirStack = dirStack[:len(dirStack)-1]
+	}
+	return nil
+}
+
+// Send a file entry of the tree
+func (c *Client) sendTreeFile(s *sendState, e TreeEntry, name string) error {
+	if err := c.sendTreeTimes(s, e.ModTime); err != nil {
+		return err
+	}
+	if err := c.sendTreeRecord(s, fmt.Sprintf("C%s %d %s\n", c.formatMode(e.Mode), e.Size, name)); err != nil {
+		return err
+	}
+
+	start := time.Now()
+	c.logEvent(LogEvent{Event: EventFileStart, Path: e.Path})
+	buf := getCopyBuffer(c.BufferSize)
+	defer putCopyBuffer(buf)
+	if _, err := c.copyBody(s, e.Reader, e.Path, e.Size, *buf); err == io.EOF {
+		return fmt.Errorf("Reader of %s provided less than %d bytes", e.Path, e.Size)
+	} else if err != nil {
+		return errors.New("Copy failed: " + err.Error())
+	}
+	if err := c.sendTreeRecord(s, "\x00"); err != nil {
+		return err
+	}
+
+	c.logEvent(LogEvent{Event: EventFileCopied, Path: e.Path, Bytes: e.Size, Duration: time.Since(start)})
+	c.infof("Copied: %s", e.Path)
+	return nil
+}
+
+// Send the T record of an entry with PreserveTimes
+func (c *Client) sendTreeTimes(s *sendState, mtime time.Time) error {
+	if !c.preserveTimes() {
+		return nil
+	}
+	if mtime.IsZero() {
+		mtime = time.Now()
+	}
+	return c.sendTreeRecord(s, fmt.Sprintf("T%d 0 %d 0\n", mtime.Unix(), time.Now().Unix()))
+}
+
+// Write a record of the tree and wait for it to be acknowledged, a warning being
+// an error
+func (c *Client) sendTreeRecord(s *sendState, record string) error {
+	if err := c.sendRecord(s.w, record); err != nil {
+		return errors.New("Copy failed: " + err.Error())
+	}
+	return c.recvAck(s.r)
+}
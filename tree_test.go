@@ -0,0 +1,39 @@
+package scp
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSortTree(t *testing.T) {
+	file := strings.NewReader("")
+	sorted, err := sortTree([]TreeEntry{
+		{Path: "a.txt", Reader: file},
+		{Path: "a/b/c", Reader: file},
+		{Path: "./a"},
+		{Path: "a/b.txt", Reader: file},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, e := range sorted {
+		paths = append(paths, e.Path)
+	}
+	if got, want := strings.Join(paths, " "), "a a/b/c a/b.txt a.txt"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	for _, entries := range [][]TreeEntry{
+		{{Path: ""}},
+		{{Path: "/abs"}},
+		{{Path: "../up"}},
+		{{Path: "new\nline"}},
+		{{Path: "a"}, {Path: "a/"}},
+		{{Path: "a", Reader: file}, {Path: "a/b", Reader: file}},
+	} {
+		if _, err := sortTree(entries); err == nil {
+			t.Errorf("%q: got no error", entries[len(entries)-1].Path)
+		}
+	}
+}